@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 // [Attributes.h] - Defining Enum using 'iota'
@@ -61,11 +62,17 @@ func matchesStr(target, source string) bool {
 	if target == "" {
 		return true
 	}
-	// Check if source starts with target (Case Insensitive)
-	if len(target) > len(source) {
-		return false
+	// Check if source starts with target (Case Insensitive), a rune at a
+	// time: case variants can differ in byte length, so slicing source by
+	// len(target) could split a character.
+	for _, tr := range target {
+		sr, size := utf8.DecodeRuneInString(source)
+		if size == 0 || !strings.EqualFold(string(sr), string(tr)) {
+			return false
+		}
+		source = source[size:]
 	}
-	return strings.EqualFold(source[:len(target)], target)
+	return true
 }
 
 func (a *Attributes) String() string {
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
 // --- Enums ---
@@ -43,8 +44,16 @@ type Attributes struct {
 
 func (a *Attributes) IsMatchBase(target *Attributes) bool {
 	// Helper to reduce code duplication
+	// Case-insensitive prefix match, rune by rune so no character is split
 	check := func(tgt, src string) bool {
-		return tgt == "" || (len(src) >= len(tgt) && strings.EqualFold(src[:len(tgt)], tgt))
+		for _, tr := range tgt {
+			sr, size := utf8.DecodeRuneInString(src)
+			if size == 0 || !strings.EqualFold(string(sr), string(tr)) {
+				return false
+			}
+			src = src[size:]
+		}
+		return true
 	}
 	return check(target.Title, a.Title) &&
 		check(target.Last, a.Last) &&
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// API serves a Catalogue as JSON over HTTP:
+//
+//	POST   /books        add a book from a JSON attributes object
+//	GET    /books        list books; ?kind=cookbook&region=China filters by
+//	                     equality (repeat a key for any of several values),
+//	                     ?q= takes the text query language, ?sort=last,-year
+//	                     orders the results (by the collation of a language
+//	                     with ?locale=sv), and ?offset= and ?limit= page
+//	                     them; ?cursor= takes the "next" of the previous
+//	                     page instead of an offset
+//	GET    /books/{id}   fetch one book
+//	GET    /isbn/{isbn}  fetch the book with an ISBN-10 or ISBN-13
+//	PUT    /books/{id}   replace a book's attributes
+//	PATCH  /books/{id}   change some attributes; null removes a key
+//	DELETE /books/{id}   remove a book
+//	GET    /search       rank books by ?text= keywords, best first; takes
+//	                     the same filters as GET /books and ?limit=
+//	GET    /facets       count the values of each of ?keys=genre,year among
+//	                     the books the GET /books filters select
+//	GET    /report       tabulate those books ?by=genre as ?format=text,
+//	                     csv or json (the default)
+//
+// Validation failures are answered with 422 and the error message, and a
+// book whose ISBN another book carries with 409.
+type API struct {
+	c *Catalogue
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+func NewAPI(c *Catalogue) http.Handler {
+	api := &API{c: c}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /books", api.create)
+	mux.HandleFunc("GET /books", api.list)
+	mux.HandleFunc("GET /books/{id}", api.get)
+	mux.HandleFunc("GET /isbn/{isbn}", api.byISBN)
+	mux.HandleFunc("PUT /books/{id}", api.replace)
+	mux.HandleFunc("PATCH /books/{id}", api.patch)
+	mux.HandleFunc("DELETE /books/{id}", api.remove)
+	mux.HandleFunc("GET /search", api.search)
+	mux.HandleFunc("GET /facets", api.facets)
+	mux.HandleFunc("GET /report", api.report)
+	return mux
+}
+
+type bookJSON struct {
+	ID         int         `json:"id"`
+	Attributes *Attributes `json:"attributes"`
+}
+
+type pageJSON struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Next   string     `json:"next,omitempty"`
+	Books  []bookJSON `json:"books"`
+}
+
+func (api *API) create(w http.ResponseWriter, r *http.Request) {
+	var attrs Attributes
+	if err := decodeBody(r, &attrs); err != nil {
+		writeError(w, decodeStatus(err), err)
+		return
+	}
+	id, err := api.c.Add(&attrs)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.Header().Set("Location", fmt.Sprintf("/books/%d", id))
+	writeJSON(w, http.StatusCreated, bookJSON{ID: id, Attributes: &attrs})
+}
+
+func (api *API) list(w http.ResponseWriter, r *http.Request) {
+	q, opts, err := listParams(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	result, err := api.c.FindPage(q, opts)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	page := pageJSON{Total: result.Total, Offset: result.Offset, Limit: opts.Limit, Next: result.Next, Books: []bookJSON{}}
+	for _, book := range result.Books {
+		page.Books = append(page.Books, bookJSON{ID: book.ID, Attributes: book.Attrs})
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+// listParams turns the query string of GET /books into a Query and the
+// order and page wanted.
+func listParams(params url.Values) (Query, FindOptions, error) {
+	opts := FindOptions{Limit: defaultPageSize}
+	var and And
+	for name, values := range params {
+		switch name {
+		case "offset", "limit":
+			n, err := strconv.Atoi(values[0])
+			if err != nil || n < 0 || name == "limit" && n == 0 {
+				return nil, opts, fmt.Errorf("invalid %s %q", name, values[0])
+			}
+			if name == "offset" {
+				opts.Offset = n
+			} else {
+				opts.Limit = min(n, maxPageSize)
+			}
+		case "sort":
+			keys, err := ParseSort(values[0])
+			if err != nil {
+				return nil, opts, err
+			}
+			opts.Sort = keys
+		case "cursor":
+			opts.Cursor = values[0]
+		case "locale":
+			if _, err := LocaleCollate(values[0]); err != nil {
+				return nil, opts, err
+			}
+			opts.Locale = values[0]
+		case "q":
+			q, err := ParseQuery(values[0])
+			if err != nil {
+				return nil, opts, err
+			}
+			and = append(and, q)
+		default:
+			k, ok := DefaultSchema.Lookup(name)
+			if !ok {
+				return nil, opts, fmt.Errorf("unknown key %q", name)
+			}
+			parsed := make([]interface{}, len(values))
+			for i, text := range values {
+				v, err := DefaultSchema.Parse(k, text)
+				if err != nil {
+					return nil, opts, err
+				}
+				parsed[i] = v
+			}
+			pred, err := Where(k, OP_IN, parsed...)
+			if err != nil {
+				return nil, opts, err
+			}
+			and = append(and, pred)
+		}
+	}
+	return and, opts, nil
+}
+
+type hitJSON struct {
+	ID         int         `json:"id"`
+	Score      float64     `json:"score"`
+	Snippet    string      `json:"snippet"`
+	Attributes *Attributes `json:"attributes"`
+}
+
+func (api *API) search(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	text := params.Get("text")
+	params.Del("text")
+	filter, opts, err := listParams(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	hits := []hitJSON{}
+	for _, hit := range api.c.Search(text, filter, opts.Limit) {
+		hits = append(hits, hitJSON{ID: hit.Book.ID, Score: hit.Score, Snippet: hit.Snippet, Attributes: hit.Book.Attrs})
+	}
+	writeJSON(w, http.StatusOK, hits)
+}
+
+type facetJSON struct {
+	Key    string      `json:"key"`
+	Counts []countJSON `json:"counts"`
+}
+
+type countJSON struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+func (api *API) facets(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	var keys []Key
+	for _, name := range strings.Split(params.Get("keys"), ",") {
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("unknown key %q", name))
+			return
+		}
+		keys = append(keys, k)
+	}
+	params.Del("keys")
+	filter, _, err := listParams(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	facets, err := api.c.Facets(filter, keys...)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	out := make([]facetJSON, len(facets))
+	for i, f := range facets {
+		out[i] = facetJSON{Key: strings.ToLower(f.Key.String()), Counts: []countJSON{}}
+		for _, fc := range f.Counts {
+			out[i].Counts = append(out[i].Counts, countJSON{Value: fc.Label, Count: fc.Count})
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+var reportTypes = map[string]string{
+	"text": "text/plain; charset=utf-8",
+	"csv":  "text/csv; charset=utf-8",
+	"json": "application/json",
+}
+
+func (api *API) report(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	format := params.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := reportTypes[format]
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown report format %q", format))
+		return
+	}
+	k, ok := DefaultSchema.Lookup(params.Get("by"))
+	if !ok {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unknown key %q", params.Get("by")))
+		return
+	}
+	params.Del("by")
+	params.Del("format")
+	filter, _, err := listParams(params)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	report, err := api.c.GroupReport(k, filter)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	var buf bytes.Buffer
+	if err := report.Write(&buf, format); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	buf.WriteTo(w)
+}
+
+func (api *API) get(w http.ResponseWriter, r *http.Request) {
+	if book, ok := api.book(w, r); ok {
+		writeJSON(w, http.StatusOK, bookJSON{ID: book.ID, Attributes: book.Attrs})
+	}
+}
+
+func (api *API) byISBN(w http.ResponseWriter, r *http.Request) {
+	isbn, err := ParseISBN(r.PathValue("isbn"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	book, ok := api.c.ByISBN(isbn)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no book with ISBN %s", isbn))
+		return
+	}
+	writeJSON(w, http.StatusOK, bookJSON{ID: book.ID, Attributes: book.Attrs})
+}
+
+func (api *API) replace(w http.ResponseWriter, r *http.Request) {
+	var attrs Attributes
+	if err := decodeBody(r, &attrs); err != nil {
+		writeError(w, decodeStatus(err), err)
+		return
+	}
+	book, ok := api.book(w, r)
+	if !ok {
+		return
+	}
+	if err := api.c.Replace(book.ID, &attrs); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bookJSON{ID: book.ID, Attributes: &attrs})
+}
+
+func (api *API) patch(w http.ResponseWriter, r *http.Request) {
+	var raw map[string]json.RawMessage
+	if err := decodeBody(r, &raw); err != nil {
+		writeError(w, decodeStatus(err), err)
+		return
+	}
+	patch := map[Key]interface{}{}
+	for name, msg := range raw {
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			writeError(w, http.StatusUnprocessableEntity, fmt.Errorf("unknown key %q", name))
+			return
+		}
+		if string(msg) == "null" {
+			patch[k] = nil
+			continue
+		}
+		v, err := decodeJSONValue(k, msg)
+		if err != nil {
+			writeError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
+		patch[k] = v
+	}
+	if book, ok := api.book(w, r); ok {
+		api.update(w, book.ID, patch)
+	}
+}
+
+func (api *API) update(w http.ResponseWriter, id int, patch map[Key]interface{}) {
+	book, err := api.c.Update(id, patch)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, bookJSON{ID: id, Attributes: book.Attrs})
+}
+
+func (api *API) remove(w http.ResponseWriter, r *http.Request) {
+	book, ok := api.book(w, r)
+	if !ok {
+		return
+	}
+	if err := api.c.Remove(book.ID); err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// book looks up the {id} of the request, answering 404 if there is none.
+func (api *API) book(w http.ResponseWriter, r *http.Request) (*Book, bool) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	book, ok := api.c.Get(id)
+	if err != nil || !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no book %q", r.PathValue("id")))
+		return nil, false
+	}
+	return book, true
+}
+
+// badBody wraps request bodies that are not well-formed JSON.
+type badBody struct{ error }
+
+func decodeBody(r *http.Request, v interface{}) error {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		return badBody{err}
+	}
+	if !json.Valid(body) {
+		return badBody{errors.New("request body is not valid JSON")}
+	}
+	return json.Unmarshal(body, v)
+}
+
+// decodeStatus answers a body that is not JSON with 400 and one that does
+// not decode to valid attributes with 422.
+func decodeStatus(err error) int {
+	if errors.As(err, &badBody{}) {
+		return http.StatusBadRequest
+	}
+	return http.StatusUnprocessableEntity
+}
+
+// statusFor maps catalogue errors to HTTP statuses.
+func statusFor(err error) int {
+	var attrErrs AttrErrors
+	var kindErr *KindError
+	var dup *DuplicateError
+	switch {
+	case errors.Is(err, ErrNoBook):
+		return http.StatusNotFound
+	case errors.As(err, &dup):
+		return http.StatusConflict
+	case errors.As(err, &attrErrs), errors.As(err, &kindErr):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
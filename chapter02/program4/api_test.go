@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sampleAPI serves a catalogue of the sample books.
+func sampleAPI(t *testing.T) (*Catalogue, http.Handler) {
+	t.Helper()
+	c := &Catalogue{}
+	if err := fill(c); err != nil {
+		t.Fatal(err)
+	}
+	return c, NewAPI(c)
+}
+
+func request(h http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w
+}
+
+// testBook is a book as the API writes it.
+type testBook struct {
+	ID         int                    `json:"id"`
+	Attributes map[string]interface{} `json:"attributes"`
+}
+
+type testPage struct {
+	Total  int        `json:"total"`
+	Offset int        `json:"offset"`
+	Limit  int        `json:"limit"`
+	Next   string     `json:"next"`
+	Books  []testBook `json:"books"`
+}
+
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+}
+
+func expect(t *testing.T, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Fatalf("status %d, want %d: %s", w.Code, status, w.Body)
+	}
+}
+
+func TestAPIBook(t *testing.T) {
+	_, h := sampleAPI(t)
+
+	w := request(h, "POST", "/books", `{"kind":"fiction","title":"Dune","last":"Herbert","genre":"scifi","isbn":"0-441-17271-7"}`)
+	expect(t, w, http.StatusCreated)
+	var created testBook
+	decode(t, w, &created)
+	path := fmt.Sprintf("/books/%d", created.ID)
+	if loc := w.Header().Get("Location"); loc != path {
+		t.Errorf("Location %q, want %q", loc, path)
+	}
+
+	var got testBook
+	w = request(h, "GET", path, "")
+	expect(t, w, http.StatusOK)
+	decode(t, w, &got)
+	if got.ID != created.ID || got.Attributes["TITLE"] != "Dune" || got.Attributes["ISBN"] != "9780441172719" {
+		t.Errorf("GET %s = %+v", path, got)
+	}
+	w = request(h, "GET", "/isbn/0441172717", "")
+	expect(t, w, http.StatusOK)
+
+	w = request(h, "PUT", path, `{"kind":"fiction","title":"Dune Messiah","last":"Herbert","year":1969,"genre":"scifi"}`)
+	expect(t, w, http.StatusOK)
+	got = testBook{}
+	decode(t, w, &got)
+	if got.Attributes["TITLE"] != "Dune Messiah" || got.Attributes["ISBN"] != nil {
+		t.Errorf("PUT %s = %+v", path, got)
+	}
+
+	w = request(h, "PATCH", path, `{"year":1970,"first":["Frank"]}`)
+	expect(t, w, http.StatusOK)
+	got = testBook{}
+	decode(t, w, &got)
+	if got.Attributes["YEAR"] != 1970.0 || got.Attributes["TITLE"] != "Dune Messiah" {
+		t.Errorf("PATCH %s = %+v", path, got)
+	}
+	w = request(h, "PATCH", path, `{"year":null}`)
+	expect(t, w, http.StatusOK)
+	got = testBook{}
+	decode(t, w, &got)
+	if _, ok := got.Attributes["YEAR"]; ok {
+		t.Errorf("PATCH %s with null year = %+v", path, got)
+	}
+
+	expect(t, request(h, "DELETE", path, ""), http.StatusNoContent)
+	expect(t, request(h, "GET", path, ""), http.StatusNotFound)
+	expect(t, request(h, "DELETE", path, ""), http.StatusNotFound)
+}
+
+// TestAPIPatchDuringDelete patches books while they are removed; each
+// PATCH must either succeed or find no book.
+func TestAPIPatchDuringDelete(t *testing.T) {
+	c, h := sampleAPI(t)
+	var wg sync.WaitGroup
+	for _, book := range c.Books() {
+		path := fmt.Sprintf("/books/%d", book.ID)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if w := request(h, "PATCH", path, `{"year":2000}`); w.Code != http.StatusOK && w.Code != http.StatusNotFound {
+				t.Errorf("PATCH %s: status %d: %s", path, w.Code, w.Body)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			if w := request(h, "DELETE", path, ""); w.Code != http.StatusNoContent {
+				t.Errorf("DELETE %s: status %d: %s", path, w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestAPIPages(t *testing.T) {
+	c, h := sampleAPI(t)
+	const query = "/books?kind=fiction&sort=title&limit=4"
+	want := len(c.Find(MustAttributes(M{KEY_KIND: FICTION})))
+
+	var ids []int
+	var titles []string
+	path := query
+	for pages := 0; ; pages++ {
+		if pages > want {
+			t.Fatal("cursors never reach the last page")
+		}
+		w := request(h, "GET", path, "")
+		expect(t, w, http.StatusOK)
+		var page testPage
+		decode(t, w, &page)
+		if page.Total != want || page.Limit != 4 || len(page.Books) > 4 {
+			t.Fatalf("GET %s: total %d, limit %d, %d books", path, page.Total, page.Limit, len(page.Books))
+		}
+		for _, book := range page.Books {
+			ids = append(ids, book.ID)
+			titles = append(titles, book.Attributes["TITLE"].(string))
+		}
+		if page.Next == "" {
+			break
+		}
+		path = query + "&cursor=" + page.Next
+	}
+	if len(ids) != want {
+		t.Fatalf("pages held %d books, want %d", len(ids), want)
+	}
+	for i := 1; i < len(titles); i++ {
+		if Collate(titles[i-1], titles[i]) > 0 {
+			t.Errorf("%q listed before %q", titles[i-1], titles[i])
+		}
+	}
+
+	w := request(h, "GET", query+"&offset=4", "")
+	expect(t, w, http.StatusOK)
+	var page testPage
+	decode(t, w, &page)
+	if page.Offset != 4 || len(page.Books) != 4 || page.Books[0].ID != ids[4] {
+		t.Errorf("GET %s&offset=4 = %+v, want books from #%d", query, page, ids[4])
+	}
+}
+
+func TestAPIErrors(t *testing.T) {
+	_, h := sampleAPI(t)
+	for _, test := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{"POST", "/books", `{"kind":`, http.StatusBadRequest},
+		{"PUT", "/books/1", `not json`, http.StatusBadRequest},
+		{"GET", "/books?limit=-1", "", http.StatusBadRequest},
+		{"GET", "/books?limit=0", "", http.StatusBadRequest},
+		{"GET", "/report?by=kind&limit=0", "", http.StatusBadRequest},
+		{"GET", "/books?sort=colour", "", http.StatusBadRequest},
+		{"GET", "/books?q=year>>1", "", http.StatusBadRequest},
+		{"GET", "/books?cursor=junk", "", http.StatusBadRequest},
+		{"GET", "/books?locale=??", "", http.StatusBadRequest},
+		{"GET", "/isbn/12345", "", http.StatusBadRequest},
+
+		{"GET", "/books/999", "", http.StatusNotFound},
+		{"GET", "/books/abc", "", http.StatusNotFound},
+		{"PUT", "/books/999", `{"kind":"fiction","title":"x","last":"y","genre":"scifi"}`, http.StatusNotFound},
+		{"PATCH", "/books/999", `{"year":2000}`, http.StatusNotFound},
+		{"DELETE", "/books/999", "", http.StatusNotFound},
+		{"GET", "/isbn/0-441-17271-7", "", http.StatusNotFound},
+
+		{"POST", "/books", `{"kind":"fiction","title":"x","last":"y","genre":"scifi","isbn":"0-15-602732-1"}`, http.StatusConflict},
+		{"PATCH", "/books/2", `{"isbn":"0-15-602732-1"}`, http.StatusConflict},
+
+		{"POST", "/books", `{"kind":"fiction","title":"x","last":"y"}`, http.StatusUnprocessableEntity},
+		{"POST", "/books", `{"kind":"fiction","title":"x","last":"y","genre":"scifi","colour":"red"}`, http.StatusUnprocessableEntity},
+		{"POST", "/books", `{"kind":"fiction","title":"x","last":"y","genre":"scifi","year":"soon"}`, http.StatusUnprocessableEntity},
+		{"PUT", "/books/1", `{"kind":"cookbook","title":"x","last":"y","genre":"scifi"}`, http.StatusUnprocessableEntity},
+		{"PATCH", "/books/1", `{"colour":"red"}`, http.StatusUnprocessableEntity},
+		{"PATCH", "/books/1", `{"genre":null}`, http.StatusUnprocessableEntity},
+	} {
+		w := request(h, test.method, test.path, test.body)
+		if w.Code != test.status {
+			t.Errorf("%s %s %s: status %d, want %d: %s", test.method, test.path, test.body, w.Code, test.status, w.Body)
+			continue
+		}
+		var body map[string]string
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == "" {
+			t.Errorf("%s %s %s: body %q has no error", test.method, test.path, test.body, w.Body)
+		}
+	}
+}
+
+func TestAPIReport(t *testing.T) {
+	_, h := sampleAPI(t)
+	for format, contentType := range reportTypes {
+		w := request(h, "GET", "/report?by=kind&format="+format, "")
+		expect(t, w, http.StatusOK)
+		if got := w.Header().Get("Content-Type"); got != contentType {
+			t.Errorf("format %s: Content-Type %q, want %q", format, got, contentType)
+		}
+		if !strings.Contains(strings.ToLower(w.Body.String()), "fiction") {
+			t.Errorf("format %s: report has no fiction row:\n%s", format, w.Body)
+		}
+	}
+	expect(t, request(h, "GET", "/report?by=kind&format=xml", ""), http.StatusBadRequest)
+}
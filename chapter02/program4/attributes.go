@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Attributes holds one value per key, or a []interface{} list for a
+// multi-valued key.
+type Attributes struct {
+	attrMap map[Key]interface{}
+}
+
+// NewAttributes validates every pair against DefaultSchema. All invalid
+// pairs are reported together as an AttrErrors. The pairs are copied, so
+// Attributes never change once made. A multi-valued key may be given one
+// value or a slice of them, such as []string{"Pratchett", "Gaiman"}.
+func NewAttributes(pairs map[Key]interface{}) (*Attributes, error) {
+	var errs AttrErrors
+	for k, v := range pairs {
+		if err := DefaultSchema.Check(k, v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		sort.Slice(errs, func(i, j int) bool { return errs[i].Key < errs[j].Key })
+		return nil, errs
+	}
+	attrs := &Attributes{attrMap: make(map[Key]interface{}, len(pairs))}
+	for k, v := range pairs {
+		if DefaultSchema.multi(k) {
+			v = listOf(v)
+		}
+		attrs.attrMap[k] = composed(v)
+	}
+	return attrs, nil
+}
+
+// listOf copies a slice into a new list; any other value becomes a list of one.
+func listOf(v interface{}) []interface{} {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return []interface{}{v}
+	}
+	list := make([]interface{}, rv.Len())
+	for i := range list {
+		list[i] = rv.Index(i).Interface()
+	}
+	return list
+}
+
+// values returns every value of k in order, or nil if a does not carry k.
+func (a *Attributes) values(k Key) []interface{} {
+	v, ok := a.attrMap[k]
+	if !ok {
+		return nil
+	}
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	return []interface{}{v}
+}
+
+// MustAttributes is like NewAttributes but panics on invalid pairs. It is
+// meant for literal fixtures such as fill.
+func MustAttributes(pairs map[Key]interface{}) *Attributes {
+	a, err := NewAttributes(pairs)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+func typeName(v interface{}) string {
+	if v == nil {
+		return "nil"
+	}
+	if t := reflect.TypeOf(v); t.Name() != "" {
+		return t.Name()
+	}
+	return reflect.TypeOf(v).String()
+}
+
+// AttrError describes one key whose value has the wrong type or, for an
+// enum key, lies outside the vocabulary.
+type AttrError struct {
+	Key   Key
+	Want  string // "" if the key itself is unknown
+	Value interface{}
+}
+
+func (e *AttrError) Error() string {
+	if e.Want == "" {
+		return fmt.Sprintf("unknown key %s", e.Key)
+	}
+	if str, ok := e.Value.(string); ok {
+		return fmt.Sprintf("%s: expected %s, got string %q", e.Key, e.Want, str)
+	}
+	if typeName(e.Value) == e.Want {
+		return fmt.Sprintf("%s: %v is not a known %s", e.Key, e.Value, e.Want)
+	}
+	return fmt.Sprintf("%s: expected %s, got %s %v", e.Key, e.Want, typeName(e.Value), e.Value)
+}
+
+// AttrErrors collects every invalid pair passed to NewAttributes.
+type AttrErrors []*AttrError
+
+func (errs AttrErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, e := range errs {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// ValidationReport is the outcome of validating a batch of records.
+type ValidationReport struct {
+	Valid    []*Attributes
+	Rejected []RecordError
+}
+
+// RecordError ties a validation error to the record's position in the batch.
+type RecordError struct {
+	Index int
+	Err   error
+}
+
+// Validate checks every record in a batch instead of stopping at the
+// first bad one.
+func Validate(records []map[Key]interface{}) *ValidationReport {
+	report := &ValidationReport{}
+	for i, pairs := range records {
+		attrs, err := NewAttributes(pairs)
+		if err != nil {
+			report.Rejected = append(report.Rejected, RecordError{Index: i, Err: err})
+			continue
+		}
+		report.Valid = append(report.Valid, attrs)
+	}
+	return report
+}
+
+func (r *ValidationReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d valid, %d rejected", len(r.Valid), len(r.Rejected))
+	for _, re := range r.Rejected {
+		fmt.Fprintf(&sb, "\n  record %d: %v", re.Index+1, re.Err)
+	}
+	return sb.String()
+}
+
+func (a *Attributes) sortedKeys() []Key {
+	keys := make([]Key, 0, len(a.attrMap))
+	for k := range a.attrMap {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+// IsMatch reports whether a carries every pair of target, comparing
+// strings by the zero Folding. For a multi-valued key any of a's values
+// may match, and each of target's values must be matched.
+func (a *Attributes) IsMatch(target *Attributes) bool { return a.isMatch(target, Folding{}) }
+
+// isMatch is IsMatch comparing strings as f folds them.
+func (a *Attributes) isMatch(target *Attributes, f Folding) bool {
+	for tKey := range target.attrMap {
+		sVals := a.values(tKey)
+		for _, tVal := range target.values(tKey) {
+			if !containsValue(sVals, tVal, f) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func containsValue(list []interface{}, tVal interface{}, f Folding) bool {
+	for _, sVal := range list {
+		// Exact Match
+		if sVal == tVal {
+			return true
+		}
+		// String Match as the folding compares strings
+		if tStr, ok1 := tVal.(string); ok1 {
+			if sStr, ok2 := sVal.(string); ok2 {
+				if f.key(sStr) == f.key(tStr) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (a *Attributes) String() string {
+	// Sort keys for deterministic output
+	keys := a.sortedKeys()
+
+	var sb strings.Builder
+	sb.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString(k.String() + ": ")
+
+		// A list of several values prints as ['Pratchett', 'Gaiman']
+		vals := a.values(k)
+		if len(vals) > 1 {
+			sb.WriteString("[")
+		}
+		for j, v := range vals {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			if str, ok := v.(string); ok {
+				sb.WriteString(fmt.Sprintf("'%s'", str))
+			} else {
+				sb.WriteString(DefaultSchema.Format(k, v))
+			}
+		}
+		if len(vals) > 1 {
+			sb.WriteString("]")
+		}
+	}
+	sb.WriteString("}")
+	return sb.String()
+}
+
+// MarshalJSON writes the attributes as an object keyed by key name, with
+// enums by name and multi-valued keys as arrays:
+// {"KIND":"fiction","LAST":["Pratchett","Gaiman"],"GENRE":"fantasy","YEAR":1990}.
+func (a *Attributes) MarshalJSON() ([]byte, error) {
+	keys := a.sortedKeys()
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		vals := a.values(k)
+		out := make([]interface{}, len(vals))
+		for j, v := range vals {
+			if _, ok := v.(int); !ok {
+				v = DefaultSchema.Format(k, v)
+			}
+			out[j] = v
+		}
+		var v interface{} = out
+		if !DefaultSchema.multi(k) {
+			v = out[0]
+		}
+		name, _ := json.Marshal(k.String())
+		val, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(val)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+// UnmarshalJSON reads the form written by MarshalJSON, rejecting unknown
+// keys, unknown enum names and values of the wrong type. A multi-valued key
+// may also be given a single value.
+func (a *Attributes) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	pairs := map[Key]interface{}{}
+	for name, msg := range raw {
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown key %q", name)
+		}
+		v, err := decodeJSONValue(k, msg)
+		if err != nil {
+			return err
+		}
+		pairs[k] = v
+	}
+	attrs, err := NewAttributes(pairs)
+	if err != nil {
+		return err
+	}
+	*a = *attrs
+	return nil
+}
+
+func decodeJSONValue(k Key, msg json.RawMessage) (interface{}, error) {
+	var msgs []json.RawMessage
+	if DefaultSchema.multi(k) && json.Unmarshal(msg, &msgs) == nil {
+		list := make([]interface{}, len(msgs))
+		for i, m := range msgs {
+			v, err := decodeJSONValue(k, m)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	}
+	if spec, _ := DefaultSchema.Spec(k); spec.Type == TYPE_INT {
+		var n int
+		if err := json.Unmarshal(msg, &n); err != nil {
+			return nil, fmt.Errorf("%s: expected an integer, got %s", k, msg)
+		}
+		return n, nil
+	}
+	var text string
+	if err := json.Unmarshal(msg, &text); err != nil {
+		return nil, fmt.Errorf("%s: expected a string, got %s", k, msg)
+	}
+	return DefaultSchema.Parse(k, text)
+}
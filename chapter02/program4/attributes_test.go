@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestNewAttributesErrors(t *testing.T) {
+	for _, test := range []struct {
+		pairs M
+		keys  []Key // the keys reported, in order
+	}{
+		{M{KEY_TITLE: 1984}, []Key{KEY_TITLE}},
+		{M{KEY_YEAR: "1984"}, []Key{KEY_YEAR}},
+		{M{KEY_GENRE: Genre(99)}, []Key{KEY_GENRE}},
+		{M{KEY_GENRE: HORROR, KEY_REGION: HORROR}, []Key{KEY_REGION}},
+		{M{KEY_ISBN: ISBN("9780156027329")}, []Key{KEY_ISBN}},
+		{M{KEY_LAST: []string{}}, []Key{KEY_LAST}},
+		{M{KEY_LAST: []interface{}{"Pratchett", 1}}, []Key{KEY_LAST}},
+		{M{KEY_TITLE: []string{"a", "b"}}, []Key{KEY_TITLE}},
+		{M{Key(99): "x", KEY_YEAR: 1.5, KEY_KIND: "fiction"}, []Key{KEY_KIND, KEY_YEAR, Key(99)}},
+	} {
+		_, err := NewAttributes(test.pairs)
+		var errs AttrErrors
+		if !errors.As(err, &errs) {
+			t.Errorf("NewAttributes(%v): error %v, want AttrErrors", test.pairs, err)
+			continue
+		}
+		var keys []Key
+		for _, e := range errs {
+			keys = append(keys, e.Key)
+		}
+		if !reflect.DeepEqual(keys, test.keys) {
+			t.Errorf("NewAttributes(%v) reported %v, want %v", test.pairs, keys, test.keys)
+		}
+	}
+}
+
+func TestCheckBook(t *testing.T) {
+	for _, test := range []struct {
+		pairs      M
+		missing    []Key
+		disallowed []Key
+	}{
+		{M{KEY_KIND: FICTION, KEY_TITLE: "Dune", KEY_LAST: "Herbert", KEY_GENRE: SCIFI}, nil, nil},
+		{M{KEY_KIND: COOKBOOK, KEY_TITLE: "x", KEY_LAST: "y", KEY_REGION: []Region{CHINA, INDIA}, KEY_YEAR: 2000}, nil, nil},
+		{M{KEY_TITLE: "Dune"}, []Key{KEY_KIND}, nil},
+		{M{KEY_KIND: FICTION, KEY_TITLE: "Dune"}, []Key{KEY_LAST, KEY_GENRE}, nil},
+		{M{KEY_KIND: HOWTO, KEY_TITLE: "x", KEY_LAST: "y", KEY_SUBJECT: DRAWING, KEY_GENRE: HORROR}, nil, []Key{KEY_GENRE}},
+		{M{KEY_KIND: COOKBOOK, KEY_TITLE: "x", KEY_GENRE: HORROR, KEY_SUBJECT: DRAWING}, []Key{KEY_LAST, KEY_REGION}, []Key{KEY_GENRE, KEY_SUBJECT}},
+	} {
+		err := DefaultSchema.CheckBook(MustAttributes(test.pairs))
+		if test.missing == nil && test.disallowed == nil {
+			if err != nil {
+				t.Errorf("CheckBook(%v): %v", test.pairs, err)
+			}
+			continue
+		}
+		var ke *KindError
+		if !errors.As(err, &ke) {
+			t.Errorf("CheckBook(%v): error %v, want a KindError", test.pairs, err)
+			continue
+		}
+		if !reflect.DeepEqual(ke.Missing, test.missing) || !reflect.DeepEqual(ke.Disallowed, test.disallowed) {
+			t.Errorf("CheckBook(%v) = missing %v, disallowed %v; want %v, %v", test.pairs, ke.Missing, ke.Disallowed, test.missing, test.disallowed)
+		}
+	}
+}
+
+func TestAddAll(t *testing.T) {
+	c := &Catalogue{}
+	report, err := c.AddAll([]map[Key]interface{}{
+		{KEY_KIND: FICTION, KEY_TITLE: "Dune", KEY_LAST: "Herbert", KEY_GENRE: SCIFI, KEY_ISBN: MustParseISBN("0-441-17271-7")},
+		{KEY_KIND: FICTION, KEY_TITLE: "Dune", KEY_YEAR: "1965"},
+		{KEY_KIND: FICTION, KEY_TITLE: "Dune"},
+		{KEY_KIND: FICTION, KEY_TITLE: "Dune", KEY_LAST: "Herbert", KEY_GENRE: SCIFI, KEY_ISBN: MustParseISBN("9780441172719")},
+		{KEY_KIND: HOWTO, KEY_TITLE: "Drawing", KEY_LAST: "Edwards", KEY_SUBJECT: DRAWING},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Valid) != 2 || c.Len() != 2 {
+		t.Errorf("%d valid, %d added, want 2:\n%s", len(report.Valid), c.Len(), report)
+	}
+	var attrErrs AttrErrors
+	var kindErr *KindError
+	var dup *DuplicateError
+	for i, want := range []interface{}{&attrErrs, &kindErr, &dup} {
+		if i >= len(report.Rejected) {
+			t.Fatalf("only %d rejected:\n%s", len(report.Rejected), report)
+		}
+		if re := report.Rejected[i]; re.Index != i+1 || !errors.As(re.Err, want) {
+			t.Errorf("rejected record %d: %v, want a %T", re.Index, re.Err, want)
+		}
+	}
+	if dup != nil && dup.ID != 1 {
+		t.Errorf("duplicate ISBN reported on book %d, want 1", dup.ID)
+	}
+}
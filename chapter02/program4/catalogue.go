@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Book is never changed after it is added; Update stores a new Book with
+// the same ID.
+type Book struct {
+	ID    int
+	Attrs *Attributes
+}
+
+func (b Book) String() string { return b.Attrs.String() }
+
+// Catalogue is safe for concurrent use. Each Find sees the books as they
+// stood at one moment; writers wait for running queries to finish.
+type Catalogue struct {
+	mu       sync.RWMutex
+	booklist []*Book // in ID order
+	byID     map[int]*Book
+	lastID   int // IDs are never reused, even after Remove
+	index    Index
+	store    *Store // nil for a catalogue that only lives in memory
+}
+
+// ErrNoBook is returned for an ID that names no book.
+var ErrNoBook = errors.New("no such book")
+
+// ErrCorruptLog is returned for a catalogue file whose records contradict
+// each other.
+var ErrCorruptLog = errors.New("corrupt catalogue log")
+
+// NewCatalogue returns an empty catalogue that compares strings as f folds
+// them. The zero Catalogue uses the zero Folding.
+func NewCatalogue(f Folding) *Catalogue {
+	return &Catalogue{index: Index{folding: f}}
+}
+
+// OpenCatalogue loads the books saved at path into a catalogue folding
+// strings by f and persists every later change there.
+func OpenCatalogue(path string, f Folding) (*Catalogue, error) {
+	c := NewCatalogue(f)
+	store, err := OpenStore(path, func(r record) error {
+		if r.op != "add" && c.byID[r.id] == nil {
+			return fmt.Errorf("book %d: %w", r.id, ErrNoBook)
+		}
+		if r.op == "add" && c.byID[r.id] != nil {
+			return fmt.Errorf("book %d added twice: %w", r.id, ErrCorruptLog)
+		}
+		if r.attrs != nil {
+			if err := DefaultSchema.CheckBook(r.attrs); err != nil {
+				return fmt.Errorf("book %d: %v", r.id, err)
+			}
+		}
+		switch r.op {
+		case "add":
+			c.insert(r.id, r.attrs)
+		case "upd":
+			c.replace(r.id, r.attrs)
+		case "del":
+			c.delete(r.id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c.store = store
+	c.lastID = max(c.lastID, store.lastID)
+	if store.torn || store.needsCompaction() {
+		if err := c.compact(); err != nil {
+			store.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Add gives the book the next ID and returns it. Books that do not carry
+// the keys DefaultSchema declares for their Kind are rejected, as are
+// books whose ISBN another book carries, with a *DuplicateError.
+func (c *Catalogue) Add(attrs *Attributes) (int, error) {
+	id, err := c.add(attrs)
+	if err == nil {
+		err = c.Sync()
+	}
+	return id, err
+}
+
+// add is Add without syncing the file, for adding a batch.
+func (c *Catalogue) add(attrs *Attributes) (int, error) {
+	if err := DefaultSchema.CheckBook(attrs); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id := c.lastID + 1
+	if err := c.index.duplicate(id, attrs); err != nil {
+		return 0, err
+	}
+	if err := c.persist(record{op: "add", id: id, attrs: attrs}); err != nil {
+		return 0, err
+	}
+	c.insert(id, attrs)
+	return id, c.maybeCompact()
+}
+
+func (c *Catalogue) Get(id int) (*Book, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	book, ok := c.byID[id]
+	return book, ok
+}
+
+// ByISBN returns the book carrying isbn.
+func (c *Catalogue) ByISBN(isbn ISBN) (*Book, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	id, ok := c.index.isbns[isbn]
+	return c.byID[id], ok
+}
+
+// Len returns the number of books.
+func (c *Catalogue) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.booklist)
+}
+
+// Books returns every book in ID order.
+func (c *Catalogue) Books() []*Book {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return append([]*Book(nil), c.booklist...)
+}
+
+// Update applies patch to a book; a nil value removes its key. The result
+// is validated like a new book and returned.
+func (c *Catalogue) Update(id int, patch map[Key]interface{}) (*Book, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	book, ok := c.byID[id]
+	if !ok {
+		return nil, ErrNoBook
+	}
+	pairs := map[Key]interface{}{}
+	for k, v := range book.Attrs.attrMap {
+		pairs[k] = v
+	}
+	for k, v := range patch {
+		if v == nil {
+			delete(pairs, k)
+		} else {
+			pairs[k] = v
+		}
+	}
+	attrs, err := NewAttributes(pairs)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.update(id, attrs); err != nil {
+		return nil, err
+	}
+	return c.byID[id], nil
+}
+
+// Replace swaps all the attributes of a book for attrs.
+func (c *Catalogue) Replace(id int, attrs *Attributes) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byID[id]; !ok {
+		return ErrNoBook
+	}
+	return c.update(id, attrs)
+}
+
+func (c *Catalogue) update(id int, attrs *Attributes) error {
+	if err := DefaultSchema.CheckBook(attrs); err != nil {
+		return err
+	}
+	if err := c.index.duplicate(id, attrs); err != nil {
+		return err
+	}
+	if err := c.persist(record{op: "upd", id: id, attrs: attrs}); err != nil {
+		return err
+	}
+	c.replace(id, attrs)
+	if err := c.maybeCompact(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *Catalogue) Remove(id int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.byID[id]; !ok {
+		return ErrNoBook
+	}
+	if err := c.persist(record{op: "del", id: id}); err != nil {
+		return err
+	}
+	c.delete(id)
+	if err := c.maybeCompact(); err != nil {
+		return err
+	}
+	return c.flush()
+}
+
+func (c *Catalogue) insert(id int, attrs *Attributes) {
+	book := &Book{ID: id, Attrs: attrs}
+	if c.byID == nil {
+		c.byID = map[int]*Book{}
+	}
+	c.byID[id] = book
+	c.booklist = append(c.booklist, book)
+	c.lastID = max(c.lastID, id)
+	c.index.add(id, attrs)
+}
+
+// replace swaps in a new Book, so callers holding the old one never see it change.
+func (c *Catalogue) replace(id int, attrs *Attributes) {
+	book := &Book{ID: id, Attrs: attrs}
+	c.index.update(id, c.byID[id].Attrs, attrs)
+	c.byID[id] = book
+	c.booklist[c.slot(id)] = book
+}
+
+func (c *Catalogue) delete(id int) {
+	c.index.remove(id, c.byID[id].Attrs)
+	delete(c.byID, id)
+	i := c.slot(id)
+	c.booklist = append(c.booklist[:i:i], c.booklist[i+1:]...)
+}
+
+// slot finds a book in booklist, which is sorted by ID.
+func (c *Catalogue) slot(id int) int {
+	return sort.Search(len(c.booklist), func(i int) bool { return c.booklist[i].ID >= id })
+}
+
+func (c *Catalogue) persist(r record) error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Append(r)
+}
+
+// Sync makes every change so far durable. Add, Update, Replace and Remove
+// sync on their own; the batch adders and importers sync once at the end.
+func (c *Catalogue) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flush()
+}
+
+// flush is Sync for a caller that already holds c.mu.
+func (c *Catalogue) flush() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Sync()
+}
+
+func (c *Catalogue) maybeCompact() error {
+	if c.store != nil && c.store.needsCompaction() {
+		return c.compact()
+	}
+	return nil
+}
+
+// AddAll adds the valid records of a batch and reports the rejected ones,
+// including those that break the rules of their Kind or whose ISBN is
+// already taken. It only stops if a book cannot be saved.
+func (c *Catalogue) AddAll(records []map[Key]interface{}) (*ValidationReport, error) {
+	report := &ValidationReport{}
+	for i, pairs := range records {
+		attrs, err := NewAttributes(pairs)
+		if err == nil {
+			_, err = c.add(attrs)
+			var dup *DuplicateError
+			var kindErr *KindError
+			if err != nil && !errors.As(err, &dup) && !errors.As(err, &kindErr) {
+				return report, err
+			}
+		}
+		if err != nil {
+			report.Rejected = append(report.Rejected, RecordError{Index: i, Err: err})
+			continue
+		}
+		report.Valid = append(report.Valid, attrs)
+	}
+	return report, c.Sync()
+}
+
+// MarshalJSON writes the catalogue as an array of book attributes.
+func (c *Catalogue) MarshalJSON() ([]byte, error) {
+	books := c.Books()
+	attrs := make([]*Attributes, len(books))
+	for i, book := range books {
+		attrs[i] = book.Attrs
+	}
+	return json.Marshal(attrs)
+}
+
+// UnmarshalJSON adds every book in a JSON array of attributes. Nothing is
+// added unless the whole array is valid.
+func (c *Catalogue) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	books := make([]*Attributes, len(raw))
+	isbns := map[ISBN]int{}
+	for i, msg := range raw {
+		books[i] = &Attributes{}
+		err := books[i].UnmarshalJSON(msg)
+		if err == nil {
+			err = DefaultSchema.CheckBook(books[i])
+		}
+		if isbn, ok := books[i].attrMap[KEY_ISBN].(ISBN); ok && err == nil {
+			if book, taken := c.ByISBN(isbn); taken {
+				err = &DuplicateError{ISBN: isbn, ID: book.ID}
+			} else if j, seen := isbns[isbn]; seen {
+				err = fmt.Errorf("ISBN %s is also on book %d", isbn, j+1)
+			}
+			isbns[isbn] = i
+		}
+		if err != nil {
+			return fmt.Errorf("book %d: %v", i+1, err)
+		}
+	}
+	for _, attrs := range books {
+		if _, err := c.add(attrs); err != nil {
+			return err
+		}
+	}
+	return c.Sync()
+}
+
+// Find answers q from the index when it can and scans the books otherwise.
+func (c *Catalogue) Find(q Query) []*Book {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.find(q)
+}
+
+// find is Find for a caller that already holds c.mu.
+func (c *Catalogue) find(q Query) []*Book {
+	if iq, ok := q.(indexedQuery); ok {
+		if ids, ok := iq.postings(&c.index); ok {
+			if len(ids) == 0 {
+				return nil
+			}
+			matches := make([]*Book, len(ids))
+			for i, id := range ids {
+				matches[i] = c.byID[id]
+			}
+			return matches
+		}
+	}
+	return c.scan(q)
+}
+
+// scan is find for a query the index cannot answer, comparing strings as
+// the catalogue folds them. The caller holds c.mu.
+func (c *Catalogue) scan(q Query) []*Book {
+	var matches []*Book
+	for _, book := range c.booklist {
+		if matchesUnder(q, book.Attrs, c.index.folding) {
+			matches = append(matches, book)
+		}
+	}
+	return matches
+}
+
+// Compact rewrites the catalogue file so it holds only the current books.
+func (c *Catalogue) Compact() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.compact()
+}
+
+func (c *Catalogue) compact() error {
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Compact(c.booklist, c.lastID)
+}
+
+func (c *Catalogue) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.store == nil {
+		return nil
+	}
+	return c.store.Close()
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+)
+
+// randomBook makes the i-th of n generated books; about twenty share each
+// author.
+func randomBook(rng *rand.Rand, i, n int) *Attributes {
+	pairs := M{
+		KEY_TITLE: fmt.Sprintf("Title %d", i),
+		KEY_LAST:  fmt.Sprintf("Author%d", rng.Intn(n/20+1)),
+		KEY_FIRST: "Pat",
+		KEY_YEAR:  1800 + rng.Intn(220),
+	}
+	switch rng.Intn(3) {
+	case 0:
+		pairs[KEY_KIND], pairs[KEY_GENRE] = FICTION, Genre(rng.Intn(8))
+	case 1:
+		pairs[KEY_KIND], pairs[KEY_REGION] = COOKBOOK, Region(rng.Intn(7))
+	default:
+		pairs[KEY_KIND], pairs[KEY_SUBJECT] = HOWTO, Subject(rng.Intn(3))
+	}
+	return MustAttributes(pairs)
+}
+
+// TestConcurrentFind runs writers and readers against one catalogue and
+// checks that every result is consistent: each book matches, in order, and
+// the index agrees with a scan. Run it with -race.
+func TestConcurrentFind(t *testing.T) {
+	const n, writes, reads = 1000, 200, 50
+	c := &Catalogue{}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		if _, err := c.Add(randomBook(rng, i, n)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queries := []Query{
+		MustAttributes(M{KEY_KIND: FICTION}),
+		MustAttributes(M{KEY_LAST: "author7"}),
+		MustWhere(KEY_YEAR, OP_BETWEEN, 1900, 1950),
+		Or{MustAttributes(M{KEY_REGION: CHINA}), MustAttributes(M{KEY_GENRE: HORROR})},
+		And{MustAttributes(M{KEY_KIND: HOWTO}), Not{MustAttributes(M{KEY_SUBJECT: DRAWING})}},
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rng := rand.New(rand.NewSource(seed))
+			for i := 0; i < writes; i++ {
+				id := 1 + rng.Intn(n)
+				switch rng.Intn(3) {
+				case 0:
+					c.Add(randomBook(rng, n+i, n))
+				case 1:
+					c.Update(id, M{KEY_YEAR: 1800 + rng.Intn(220)})
+				default:
+					c.Remove(id)
+				}
+			}
+		}(int64(w + 2))
+	}
+	for r := 0; r < 8; r++ {
+		wg.Add(1)
+		go func(r int) {
+			defer wg.Done()
+			for i := r; i < r+reads; i++ {
+				q := queries[i%len(queries)]
+				if err := checkFind(c, q); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := checkFindPage(c, q); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+func checkFind(c *Catalogue, q Query) error {
+	books := c.Find(q)
+	for i, book := range books {
+		if !q.Matches(book.Attrs) {
+			return fmt.Errorf("%s: #%d does not match", q, book.ID)
+		}
+		if i > 0 && books[i-1].ID >= book.ID {
+			return fmt.Errorf("%s: #%d out of order", q, book.ID)
+		}
+	}
+	c.mu.RLock()
+	scan := c.scan(q)
+	index := c.find(q)
+	c.mu.RUnlock()
+	if len(scan) != len(index) {
+		return fmt.Errorf("%s: index found %d books, scan %d", q, len(index), len(scan))
+	}
+	return nil
+}
+
+// checkFindPage checks that a page of results sorted by year matches q
+// and is in order.
+func checkFindPage(c *Catalogue, q Query) error {
+	page, err := c.FindPage(q, FindOptions{Sort: []SortKey{{Key: KEY_YEAR}}, Limit: 20})
+	if err != nil {
+		return err
+	}
+	if len(page.Books) > page.Total {
+		return fmt.Errorf("%s: page of %d books out of %d", q, len(page.Books), page.Total)
+	}
+	for i, book := range page.Books {
+		if !q.Matches(book.Attrs) {
+			return fmt.Errorf("%s: page has #%d, which does not match", q, book.ID)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := page.Books[i-1]
+		py, y := prev.Attrs.attrMap[KEY_YEAR].(int), book.Attrs.attrMap[KEY_YEAR].(int)
+		if py > y || py == y && prev.ID >= book.ID {
+			return fmt.Errorf("%s: page has #%d out of order", q, book.ID)
+		}
+	}
+	return nil
+}
+
+// benchCatalogue holds generated books for the benchmarks.
+func benchCatalogue(b *testing.B, n int) *Catalogue {
+	b.Helper()
+	rng := rand.New(rand.NewSource(1))
+	c := &Catalogue{}
+	for i := 0; i < n; i++ {
+		if _, err := c.Add(randomBook(rng, i, n)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return c
+}
+
+var benchQueries = []struct {
+	name string
+	q    *Attributes
+}{
+	{"author", MustAttributes(M{KEY_KIND: FICTION, KEY_LAST: "author7", KEY_GENRE: HORROR})},
+	{"year", MustAttributes(M{KEY_YEAR: 1960, KEY_GENRE: SCIFI})},
+	{"region", MustAttributes(M{KEY_REGION: CHINA})},
+}
+
+func BenchmarkFindIndexed(b *testing.B) {
+	c := benchCatalogue(b, 100000)
+	for _, bq := range benchQueries {
+		b.Run(bq.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.Find(bq.q)
+			}
+		})
+	}
+}
+
+func BenchmarkFindScan(b *testing.B) {
+	c := benchCatalogue(b, 100000)
+	for _, bq := range benchQueries {
+		b.Run(bq.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				c.mu.RLock()
+				c.scan(bq.q)
+				c.mu.RUnlock()
+			}
+		})
+	}
+}
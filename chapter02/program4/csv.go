@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A CSV file has a header line naming a key in each column, matched
+// ignoring case, and a book on every other line:
+//
+//	ID,KIND,TITLE,LAST,FIRST,YEAR,GENRE
+//	,fiction,Good Omens,Pratchett;Gaiman,Terry;Neil,1990,fantasy
+//
+// Values are written as Parse reads them; an empty cell leaves the key
+// out, and the values of a multi-valued key are separated by semicolons.
+// An ID column is written by the exporter and ignored by the importer,
+// since the catalogue hands out its own IDs.
+const csvListSep = ";"
+
+// ImportReport is the outcome of importing a batch of rows.
+type ImportReport struct {
+	Added    []int // IDs of the new books, in input order
+	Rejected []LineError
+}
+
+// LineError ties an error to the line of the input it was found on.
+type LineError struct {
+	Line int
+	Err  error
+}
+
+func (e LineError) Error() string { return fmt.Sprintf("line %d: %v", e.Line, e.Err) }
+
+func (r *ImportReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d added, %d rejected", len(r.Added), len(r.Rejected))
+	for _, le := range r.Rejected {
+		fmt.Fprintf(&sb, "\n  %v", le)
+	}
+	return sb.String()
+}
+
+// ImportCSV adds a book for each valid row and reports the others, such
+// as rows whose ISBN is already taken, by line number without stopping.
+// It only fails outright on a bad header or if a book cannot be saved.
+func (c *Catalogue) ImportCSV(r io.Reader) (*ImportReport, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	header, err := cr.Read()
+	if err == io.EOF {
+		return &ImportReport{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("csv header: %v", err)
+	}
+	keys, err := csvColumns(header)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{}
+	for {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		var pe *csv.ParseError
+		if errors.As(err, &pe) {
+			report.Rejected = append(report.Rejected, LineError{Line: pe.StartLine, Err: pe.Err})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		line, _ := cr.FieldPos(0)
+		if len(row) != len(header) {
+			err = fmt.Errorf("%d fields, want %d", len(row), len(header))
+		}
+		var attrs *Attributes
+		if err == nil {
+			attrs, err = csvAttributes(keys, row)
+		}
+		if err == nil {
+			err = DefaultSchema.CheckBook(attrs)
+		}
+		if err != nil {
+			report.Rejected = append(report.Rejected, LineError{Line: line, Err: err})
+			continue
+		}
+		id, err := c.add(attrs)
+		var dup *DuplicateError
+		if errors.As(err, &dup) {
+			report.Rejected = append(report.Rejected, LineError{Line: line, Err: err})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Added = append(report.Added, id)
+	}
+	return report, c.Sync()
+}
+
+// csvColumns maps the header to keys; -1 marks the ID column.
+func csvColumns(header []string) ([]Key, error) {
+	keys := make([]Key, len(header))
+	seen := map[Key]bool{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\uFEFF"))
+		if strings.EqualFold(name, "id") {
+			keys[i] = -1
+			continue
+		}
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("csv header: unknown column %q", name)
+		}
+		if seen[k] {
+			return nil, fmt.Errorf("csv header: column %s given twice", k)
+		}
+		seen[k] = true
+		keys[i] = k
+	}
+	return keys, nil
+}
+
+func csvAttributes(keys []Key, row []string) (*Attributes, error) {
+	pairs := map[Key]interface{}{}
+	for i, cell := range row {
+		k := keys[i]
+		if k < 0 || strings.TrimSpace(cell) == "" {
+			continue
+		}
+		texts := []string{cell}
+		if DefaultSchema.multi(k) {
+			texts = strings.Split(cell, csvListSep)
+		}
+		var values []interface{}
+		for _, text := range texts {
+			if text = strings.TrimSpace(text); text == "" {
+				continue
+			}
+			v, err := DefaultSchema.Parse(k, text)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if DefaultSchema.multi(k) {
+			pairs[k] = values
+		} else {
+			pairs[k] = values[0]
+		}
+	}
+	return NewAttributes(pairs)
+}
+
+// ExportCSV writes the books q matches as CSV, or every book for a nil q.
+func (c *Catalogue) ExportCSV(w io.Writer, q Query) error {
+	books := c.Books()
+	if q != nil {
+		books = c.Find(q)
+	}
+	return WriteCSV(w, books)
+}
+
+// WriteCSV writes books with an ID column and a column for each key any
+// of them carries, in schema order.
+func WriteCSV(w io.Writer, books []*Book) error {
+	carried := map[Key]bool{}
+	for _, book := range books {
+		for k := range book.Attrs.attrMap {
+			carried[k] = true
+		}
+	}
+	header := []string{"ID"}
+	var keys []Key
+	for _, k := range DefaultSchema.Keys() {
+		if carried[k] {
+			header = append(header, k.String())
+			keys = append(keys, k)
+		}
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write(header)
+	for _, book := range books {
+		row := []string{strconv.Itoa(book.ID)}
+		for _, k := range keys {
+			var texts []string
+			for _, v := range book.Attrs.values(k) {
+				text := DefaultSchema.Format(k, v)
+				if DefaultSchema.multi(k) && strings.Contains(text, csvListSep) {
+					return fmt.Errorf("book #%d: %s %q contains %q", book.ID, k, text, csvListSep)
+				}
+				texts = append(texts, text)
+			}
+			row = append(row, strings.Join(texts, csvListSep))
+		}
+		cw.Write(row)
+	}
+	cw.Flush()
+	return cw.Error()
+}
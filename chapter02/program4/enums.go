@@ -0,0 +1,94 @@
+package main
+
+type Key int
+
+const (
+	KEY_KIND Key = iota
+	KEY_TITLE
+	KEY_LAST
+	KEY_FIRST
+	KEY_YEAR
+	KEY_GENRE
+	KEY_REGION
+	KEY_SUBJECT
+	KEY_ISBN
+)
+
+func (k Key) String() string { return DefaultSchema.keyName(k) }
+
+type Kind int
+
+const (
+	FICTION Kind = iota
+	COOKBOOK
+	HOWTO
+)
+
+func (k Kind) String() string { return DefaultSchema.valueName(KEY_KIND, int(k)) }
+
+type Genre int
+
+const (
+	ADVENTURE Genre = iota
+	CLASSICS
+	DETECTIVE
+	FANTASY
+	HISTORIC
+	HORROR
+	ROMANCE
+	SCIFI
+)
+
+func (g Genre) String() string { return DefaultSchema.valueName(KEY_GENRE, int(g)) }
+
+type Region int
+
+const (
+	CHINA Region = iota
+	FRANCE
+	INDIA
+	ITALY
+	MEXICO
+	PERSIA
+	US
+)
+
+func (r Region) String() string { return DefaultSchema.valueName(KEY_REGION, int(r)) }
+
+type Subject int
+
+const (
+	DRAWING Subject = iota
+	PAINTING
+	WRITING
+)
+
+func (s Subject) String() string { return DefaultSchema.valueName(KEY_SUBJECT, int(s)) }
+
+// Enum is the value type of enum keys registered at runtime: a position
+// in the key's vocabulary.
+type Enum int
+
+func ParseKind(s string) (Kind, error) {
+	v, err := DefaultSchema.Parse(KEY_KIND, s)
+	kind, _ := v.(Kind)
+	return kind, err
+}
+
+func ParseGenre(s string) (Genre, error) {
+	v, err := DefaultSchema.Parse(KEY_GENRE, s)
+	genre, _ := v.(Genre)
+	return genre, err
+}
+
+func ParseRegion(s string) (Region, error) {
+	v, err := DefaultSchema.Parse(KEY_REGION, s)
+	region, _ := v.(Region)
+	return region, err
+}
+
+func ParseSubject(s string) (Subject, error) {
+	v, err := DefaultSchema.Parse(KEY_SUBJECT, s)
+	subject, _ := v.(Subject)
+	return subject, err
+}
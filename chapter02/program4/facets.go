@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FacetCount is how many of the matching books carry one value of a key.
+type FacetCount struct {
+	Value interface{} // the value; for KEY_YEAR, the first year of a decade
+	Label string      // the value as shown, such as "horror" or "1960s"
+	Count int
+}
+
+func (fc FacetCount) String() string { return fmt.Sprintf("%s (%d)", fc.Label, fc.Count) }
+
+// Facet holds the counts for one key, the most common value first. Years
+// are counted by decade and listed in order.
+type Facet struct {
+	Key    Key
+	Counts []FacetCount
+}
+
+func (f Facet) String() string {
+	counts := make([]string, len(f.Counts))
+	for i, fc := range f.Counts {
+		counts[i] = fc.String()
+	}
+	return fmt.Sprintf("%s: %s", f.Key, strings.Join(counts, ", "))
+}
+
+// Facets counts, for each of keys, how many of the books q matches carry
+// each of its values; a nil q counts every book. For a nil q the counts
+// are the lengths of the index's posting lists; otherwise only the values
+// of the matching books are read.
+func (c *Catalogue) Facets(q Query, keys ...Key) ([]Facet, error) {
+	for _, k := range keys {
+		if _, ok := DefaultSchema.Spec(k); !ok {
+			return nil, fmt.Errorf("unknown key %s", k)
+		}
+		if DefaultSchema.text(k) {
+			return nil, fmt.Errorf("%s is free text and has no facets", k)
+		}
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var ids []int
+	if q != nil {
+		ids = c.matchingIDs(q)
+	}
+	facets := make([]Facet, len(keys))
+	for i, k := range keys {
+		facets[i] = c.facet(k, ids, q == nil)
+	}
+	return facets, nil
+}
+
+// matchingIDs is find returning IDs. The caller holds c.mu.
+func (c *Catalogue) matchingIDs(q Query) []int {
+	if iq, ok := q.(indexedQuery); ok {
+		if ids, ok := iq.postings(&c.index); ok {
+			return ids
+		}
+	}
+	var ids []int
+	for _, book := range c.scan(q) {
+		ids = append(ids, book.ID)
+	}
+	return ids
+}
+
+// tally counts the books filed under one index term.
+type tally struct {
+	n, first, last int
+}
+
+// facet counts the values of k over ids, or over every book if all is set.
+func (c *Catalogue) facet(k Key, ids []int, all bool) Facet {
+	tallies := map[interface{}]*tally{}
+	if all {
+		for term, list := range c.index.postings[k] {
+			tallies[term] = &tally{n: len(list), first: list[0]}
+		}
+	}
+	for _, id := range ids {
+		for _, v := range c.byID[id].Attrs.values(k) {
+			term := c.index.folding.term(v)
+			t := tallies[term]
+			if t == nil {
+				t = &tally{first: id}
+				tallies[term] = t
+			} else if t.last == id {
+				continue // two values with the same term
+			}
+			t.n++
+			t.last = id
+		}
+	}
+
+	counts := map[interface{}]*FacetCount{}
+	for term, t := range tallies {
+		n, first := t.n, t.first
+		fc := FacetCount{Value: term}
+		switch v := term.(type) {
+		case string:
+			// the term is folded; show the spelling of a matching book
+			fc.Label = c.byID[first].Attrs.valueFor(c.index.folding, k, term)
+			fc.Value = fc.Label
+		case int:
+			if k == KEY_YEAR {
+				fc.Value = v - (v%10+10)%10
+				fc.Label = fmt.Sprintf("%ds", fc.Value)
+			} else {
+				fc.Label = DefaultSchema.Format(k, v)
+			}
+		default:
+			fc.Label = DefaultSchema.Format(k, v)
+		}
+		if prev, ok := counts[fc.Value]; ok {
+			prev.Count += n
+			continue
+		}
+		fc.Count = n
+		counts[fc.Value] = &fc
+	}
+
+	f := Facet{Key: k, Counts: make([]FacetCount, 0, len(counts))}
+	for _, fc := range counts {
+		f.Counts = append(f.Counts, *fc)
+	}
+	sort.Slice(f.Counts, func(i, j int) bool {
+		a, b := f.Counts[i], f.Counts[j]
+		if k != KEY_YEAR && a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if s, ok := a.Value.(string); ok {
+			return Collate(s, b.Value.(string)) < 0
+		}
+		return ordinal(a.Value) < ordinal(b.Value)
+	})
+	return f
+}
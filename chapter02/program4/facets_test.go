@@ -0,0 +1,73 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func facetStrings(facets []Facet) string {
+	s := make([]string, len(facets))
+	for i, f := range facets {
+		s[i] = f.String()
+	}
+	return strings.Join(s, "\n")
+}
+
+func TestFacets(t *testing.T) {
+	c := sampleCatalogue(t)
+	for _, test := range []struct {
+		query string
+		keys  []Key
+		want  string
+	}{
+		{"", []Key{KEY_KIND, KEY_GENRE}, "KIND: fiction (14), cookbook (10), howto (1)\nGENRE: classics (4), horror (3), adventure (2), detective (2), scifi (2), fantasy (1)"},
+		{"kind:cookbook", []Key{KEY_REGION}, "REGION: China (2), India (2), Italy (2), US (2), France (1), Persia (1)"},
+		{"genre:horror,scifi", []Key{KEY_YEAR}, "YEAR: 1810s (1), 1960s (1), 1970s (1), 1980s (2)"},
+		{"year>=1980", []Key{KEY_LAST}, "LAST: Card (1), Gaiman (1), King (1), Martel (1), Pratchett (1)"},
+		{"last:tolstoy", []Key{KEY_KIND, KEY_REGION}, "KIND: \nREGION: "},
+	} {
+		var q Query
+		if test.query != "" {
+			var err error
+			if q, err = ParseQuery(test.query); err != nil {
+				t.Fatal(err)
+			}
+		}
+		facets, err := c.Facets(q, test.keys...)
+		if err != nil {
+			t.Errorf("Facets(%s): %v", test.query, err)
+			continue
+		}
+		if got := facetStrings(facets); got != test.want {
+			t.Errorf("Facets(%s) =\n%s\nwant\n%s", test.query, got, test.want)
+		}
+	}
+	if _, err := c.Facets(nil, KEY_TITLE); err == nil {
+		t.Error("Facets of free text succeeded")
+	}
+	if _, err := c.Facets(nil, Key(99)); err == nil {
+		t.Error("Facets of an unknown key succeeded")
+	}
+}
+
+// TestFacetsAfterChanges checks that the counts of every book follow
+// updates and removals.
+func TestFacetsAfterChanges(t *testing.T) {
+	c := sampleCatalogue(t)
+	if _, err := c.Update(9, M{KEY_GENRE: SCIFI}); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{10, 11} {
+		if err := c.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	facets, err := c.Facets(nil, KEY_GENRE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const want = "GENRE: classics (4), scifi (3), adventure (2), detective (2), fantasy (1)"
+	if got := facetStrings(facets); got != want {
+		t.Errorf("Facets = %s, want %s", got, want)
+	}
+}
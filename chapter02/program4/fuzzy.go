@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+)
+
+// Fuzzy builds an OP_FUZZY predicate that matches string values within
+// maxDist edits of text. Where(k, OP_FUZZY, text) picks the distance from
+// the length of text instead.
+func Fuzzy(k Key, text string, maxDist int) (*Predicate, error) {
+	if maxDist < 0 {
+		return nil, fmt.Errorf("%s fuzzy: negative distance %d", k, maxDist)
+	}
+	p, err := Where(k, OP_FUZZY, text)
+	if err != nil {
+		return nil, err
+	}
+	p.dist = maxDist
+	return p, nil
+}
+
+// autoFuzziness is the edit distance allowed for a word of this many
+// runes: none for very short words, where any edit changes the word, one
+// for short and two for longer ones.
+func autoFuzziness(text string) int {
+	switch n := utf8.RuneCountInString(text); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+// editDistance is the Damerau-Levenshtein distance between a and b:
+// inserting, deleting or substituting a rune, or swapping two adjacent
+// runes, each costs one edit, and a swapped pair may be edited again, so
+// "ca" is two edits from "abc". It stops early and returns limit+1 once
+// the distance must exceed limit.
+func editDistance(a, b string, limit int) int {
+	s, t := []rune(a), []rune(b)
+	if len(s)-len(t) > limit || len(t)-len(s) > limit {
+		return limit + 1
+	}
+	// d[i+1][j+1] is the distance between s[:i] and t[:j]; row and column
+	// 0 hold a bound no distance reaches.
+	inf := len(s) + len(t)
+	d := make([][]int, len(s)+2)
+	for i := range d {
+		d[i] = make([]int, len(t)+2)
+		d[i][0] = inf
+		if i > 0 {
+			d[i][1] = i - 1
+		}
+	}
+	for j := 1; j < len(t)+2; j++ {
+		d[0][j], d[1][j] = inf, j-1
+	}
+	last := map[rune]int{} // the last row of s holding each rune
+	for i := 1; i <= len(s); i++ {
+		match := 0 // the last column of t matching s[i-1] so far
+		rowMin := i
+		for j := 1; j <= len(t); j++ {
+			k, l := last[t[j-1]], match
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost, match = 0, j
+			}
+			d[i+1][j+1] = min(d[i][j]+cost, d[i+1][j]+1, d[i][j+1]+1, d[k][l]+(i-k-1)+1+(j-l-1))
+			rowMin = min(rowMin, d[i+1][j+1])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		last[s[i-1]] = i
+	}
+	return min(d[len(s)+1][len(t)+1], limit+1)
+}
+
+// FuzzyMatch is a book found by FindFuzzy, with the value of the key that
+// came closest to the text and its distance in edits.
+type FuzzyMatch struct {
+	Book     *Book
+	Value    string
+	Distance int
+}
+
+func (m FuzzyMatch) String() string {
+	return fmt.Sprintf("%s (%q, %d edits)", m.Book, m.Value, m.Distance)
+}
+
+// FindFuzzy finds the books whose string key k has a value within maxDist
+// edits of text, ignoring case, closest first. Books at the same distance
+// stay in ID order.
+func (c *Catalogue) FindFuzzy(k Key, text string, maxDist int) ([]FuzzyMatch, error) {
+	p, err := Fuzzy(k, text, maxDist)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fold := c.index.folding.key(p.Values[0].(string))
+	best := map[int]FuzzyMatch{}
+	for term, ids := range c.index.postings[k] {
+		d := editDistance(fold, term.(string), maxDist)
+		if d > maxDist {
+			continue
+		}
+		for _, id := range ids {
+			if m, seen := best[id]; !seen || d < m.Distance {
+				book := c.byID[id]
+				best[id] = FuzzyMatch{Book: book, Value: book.Attrs.valueFor(c.index.folding, k, term), Distance: d}
+			}
+		}
+	}
+	matches := make([]FuzzyMatch, 0, len(best))
+	for _, m := range best {
+		matches = append(matches, m)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Distance != matches[j].Distance {
+			return matches[i].Distance < matches[j].Distance
+		}
+		return matches[i].Book.ID < matches[j].Book.ID
+	})
+	return matches, nil
+}
+
+// valueFor returns the value of k that is filed under the index term.
+func (a *Attributes) valueFor(f Folding, k Key, term interface{}) string {
+	for _, v := range a.values(k) {
+		if f.term(v) == term {
+			return DefaultSchema.Format(k, v)
+		}
+	}
+	return ""
+}
+
+// Suggest proposes the existing value of string key k closest to text,
+// such as an author's name for a misspelling of it. Ties go to the value
+// more books carry. It reports false if nothing is close enough.
+func (c *Catalogue) Suggest(k Key, text string) (string, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.suggest(k, text)
+}
+
+// suggestLimit is the distance Suggest looks within; it is more lenient
+// than autoFuzziness since a suggestion is only shown, never applied.
+func suggestLimit(text string) int {
+	return max(1, utf8.RuneCountInString(text)/3)
+}
+
+func (c *Catalogue) suggest(k Key, text string) (string, bool) {
+	fold := c.index.folding.key(text)
+	limit := suggestLimit(text)
+	best, bestDist, bestBooks := "", limit+1, 0
+	for term, ids := range c.index.postings[k] {
+		str, ok := term.(string)
+		if !ok || str == fold {
+			continue
+		}
+		d := editDistance(fold, str, limit)
+		switch {
+		case d > bestDist:
+			continue
+		case d == bestDist && len(ids) < bestBooks:
+			continue
+		case d == bestDist && len(ids) == bestBooks && str > best:
+			continue
+		}
+		best, bestDist, bestBooks = str, d, len(ids)
+	}
+	if bestDist > limit {
+		return "", false
+	}
+	ids := c.index.postings[k][best]
+	return c.byID[ids[0]].Attrs.valueFor(c.index.folding, k, best), true
+}
+
+// DidYouMean rewrites q, replacing every string value that no book
+// carries with the closest one that some book does. It reports false if
+// nothing could be replaced or the rewritten query still finds nothing.
+func (c *Catalogue) DidYouMean(q Query) (Query, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s, changed := c.respell(q)
+	if !changed || len(c.find(s)) == 0 {
+		return nil, false
+	}
+	return s, true
+}
+
+// respell returns q with its unknown string values replaced, and whether
+// any were.
+func (c *Catalogue) respell(q Query) (Query, bool) {
+	switch q := q.(type) {
+	case *Attributes:
+		pairs := map[Key]interface{}{}
+		changed := false
+		for k, v := range q.attrMap {
+			vals, ok := c.respellValues(k, q.values(k))
+			if ok {
+				v, changed = vals, true
+				if !DefaultSchema.multi(k) {
+					v = vals[0]
+				}
+			}
+			pairs[k] = v
+		}
+		if !changed {
+			return q, false
+		}
+		attrs, err := NewAttributes(pairs)
+		return attrs, err == nil
+	case *Predicate:
+		if q.Op != OP_EQ && q.Op != OP_IN {
+			return q, false
+		}
+		vals, ok := c.respellValues(q.Key, q.Values)
+		if !ok {
+			return q, false
+		}
+		p, err := Where(q.Key, q.Op, vals...)
+		return p, err == nil
+	case And:
+		out, changed := c.respellAll(q)
+		return And(out), changed
+	case Or:
+		out, changed := c.respellAll(q)
+		return Or(out), changed
+	case Not:
+		s, changed := c.respell(q.Query)
+		return Not{s}, changed
+	}
+	return q, false
+}
+
+func (c *Catalogue) respellAll(queries []Query) ([]Query, bool) {
+	out := make([]Query, len(queries))
+	changed := false
+	for i, q := range queries {
+		var ok bool
+		if out[i], ok = c.respell(q); ok {
+			changed = true
+		}
+	}
+	return out, changed
+}
+
+func (c *Catalogue) respellValues(k Key, values []interface{}) ([]interface{}, bool) {
+	out := make([]interface{}, len(values))
+	changed := false
+	for i, v := range values {
+		out[i] = v
+		str, ok := v.(string)
+		if !ok || len(c.index.lookup(k, str)) > 0 {
+			continue
+		}
+		if s, ok := c.suggest(k, str); ok {
+			out[i], changed = s, true
+		}
+	}
+	return out, changed
+}
@@ -1,391 +1,734 @@
 package main
 
 import (
+	"bytes"
+	"flag"
 	"fmt"
-	"sort"
+	"io"
+	"log"
+	"net/http"
+	"os"
 	"strings"
+	"time"
 )
 
-// ================= 1. ENUMS =================
-type Key int
-
-const (
-	KEY_KIND Key = iota
-	KEY_TITLE
-	KEY_LAST
-	KEY_FIRST
-	KEY_YEAR
-	KEY_GENRE
-	KEY_REGION
-	KEY_SUBJECT
-)
-
-var keyNames = [...]string{"KIND", "TITLE", "LAST", "FIRST", "YEAR", "GENRE", "REGION", "SUBJECT"}
-
-func (k Key) String() string { return keyNames[k] }
-
-type Kind int
-
-const (
-	FICTION Kind = iota
-	COOKBOOK
-	HOWTO
-)
-
-func (k Kind) String() string { return []string{"fiction", "cookbook", "howto"}[k] }
-
-type Genre int
-
-const (
-	ADVENTURE Genre = iota
-	CLASSICS
-	DETECTIVE
-	FANTASY
-	HISTORIC
-	HORROR
-	ROMANCE
-	SCIFI
-)
-
-func (g Genre) String() string {
-	return []string{"adventure", "classics", "detective", "fantasy", "historic", "horror", "romance", "scifi"}[g]
-}
-
-type Region int
-
-const (
-	CHINA Region = iota
-	FRANCE
-	INDIA
-	ITALY
-	MEXICO
-	PERSIA
-	US
-)
-
-func (r Region) String() string {
-	return []string{"China", "France", "India", "Italy", "Mexico", "Persia", "US"}[r]
-}
-
-type Subject int
-
-const (
-	DRAWING Subject = iota
-	PAINTING
-	WRITING
-)
-
-func (s Subject) String() string { return []string{"drawing", "painting", "writing"}[s] }
-
-// ================= 2. ATTRIBUTES =================
-type Attributes struct {
-	attrMap map[Key]interface{}
-}
+// Helper type alias to make the filling code cleaner
+type M map[Key]interface{}
 
-func NewAttributes(pairs map[Key]interface{}) *Attributes {
-	// Validation logic ensuring types match keys
-	for k, v := range pairs {
-		isValid := false
-		switch k {
-		case KEY_YEAR:
-			_, isValid = v.(int)
-		case KEY_TITLE, KEY_LAST, KEY_FIRST:
-			_, isValid = v.(string)
-		case KEY_KIND:
-			_, isValid = v.(Kind)
-		case KEY_GENRE:
-			_, isValid = v.(Genre)
-		case KEY_REGION:
-			_, isValid = v.(Region)
-		case KEY_SUBJECT:
-			_, isValid = v.(Subject)
+func main() {
+	dbPath := flag.String("db", "", "file to load the catalogue from and save it to")
+	schemaPath := flag.String("schema", "", "JSON file declaring extra keys and kinds")
+	repl := flag.Bool("repl", false, "start an interactive shell instead of running the demo")
+	addr := flag.String("http", "", "serve the catalogue over HTTP on this address instead of running the demo")
+	opds := flag.Bool("opds", false, "with -http, also serve the catalogue as an OPDS catalog under /opds")
+	translit := flag.Bool("translit", false, "match Greek and Cyrillic text against its Latin spelling")
+	flag.Parse()
+	folding := Folding{Transliterate: *translit}
+
+	if *schemaPath != "" {
+		if err := DefaultSchema.LoadSchema(*schemaPath); err != nil {
+			log.Fatal(err)
 		}
+	}
 
-		if !isValid {
-			panic(fmt.Sprintf("Invalid type for Key: %s", k))
+	catalogue := NewCatalogue(folding)
+	if *dbPath != "" {
+		var err error
+		if catalogue, err = OpenCatalogue(*dbPath, folding); err != nil {
+			log.Fatal(err)
 		}
+		defer catalogue.Close()
 	}
-	return &Attributes{attrMap: pairs}
-}
-
-func (a *Attributes) IsMatch(target *Attributes) bool {
-	for tKey, tVal := range target.attrMap {
-		sVal, exists := a.attrMap[tKey]
-		if !exists {
-			return false
+	if *dbPath == "" || (!*repl && *addr == "" && catalogue.Len() == 0) {
+		if err := fill(catalogue); err != nil {
+			log.Fatal(err)
 		}
-		// Exact Match
-		if sVal == tVal {
-			continue
+	}
+	if *addr != "" {
+		log.Printf("serving %d books on %s", catalogue.Len(), *addr)
+		handler := NewAPI(catalogue)
+		if *opds {
+			mux := http.NewServeMux()
+			mux.Handle("/", handler)
+			mux.Handle("/opds", NewOPDS(catalogue, "/opds"))
+			mux.Handle("/opds/", NewOPDS(catalogue, "/opds"))
+			handler = mux
 		}
-		// String Case-Insensitive Match
-		if tStr, ok1 := tVal.(string); ok1 {
-			if sStr, ok2 := sVal.(string); ok2 {
-				if strings.EqualFold(sStr, tStr) {
-					continue
-				}
-			}
+		log.Fatal(http.ListenAndServe(*addr, handler))
+	}
+	if *repl {
+		if err := NewShell(catalogue, os.Stdin, os.Stdout).Run(); err != nil {
+			log.Fatal(err)
 		}
-		return false
+		return
 	}
-	return true
+	demo(catalogue)
 }
 
-func (a *Attributes) String() string {
-	// Sort keys for deterministic output
-	var keys []int
-	for k := range a.attrMap {
-		keys = append(keys, int(k))
+// fill adds the sample books.
+func fill(c *Catalogue) error {
+	for _, pairs := range []M{
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Life of Pi",
+			KEY_LAST: "Martel", KEY_FIRST: "Yann",
+			KEY_YEAR: 2003, KEY_GENRE: ADVENTURE,
+			KEY_ISBN: MustParseISBN("0-15-602732-1"),
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "The Call of the Wild",
+			KEY_LAST: "London", KEY_FIRST: "Jack",
+			KEY_YEAR: 1903, KEY_GENRE: ADVENTURE,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "To Kill a Mockingbird",
+			KEY_LAST: "Lee", KEY_FIRST: "Harper",
+			KEY_YEAR: 1960, KEY_GENRE: CLASSICS,
+			KEY_ISBN: MustParseISBN("978-0-06-112008-4"),
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Little Women",
+			KEY_LAST: "Alcott", KEY_FIRST: "Louisa",
+			KEY_YEAR: 1868, KEY_GENRE: CLASSICS,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Thérèse Raquin",
+			KEY_LAST: "Zola", KEY_FIRST: "Émile",
+			KEY_YEAR: 1867, KEY_GENRE: CLASSICS,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Дама с собачкой",
+			KEY_LAST: "Чехов", KEY_FIRST: "Антон",
+			KEY_YEAR: 1899, KEY_GENRE: CLASSICS,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "The Adventures of Sherlock Holmes",
+			KEY_LAST: "Doyle", KEY_FIRST: "Conan",
+			KEY_YEAR: 1892, KEY_GENRE: DETECTIVE,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "And Then There Were None",
+			KEY_LAST: "Christie", KEY_FIRST: "Agatha",
+			KEY_YEAR: 1939, KEY_GENRE: DETECTIVE,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Carrie",
+			KEY_LAST: "King", KEY_FIRST: "Stephen",
+			KEY_YEAR: 1974, KEY_GENRE: HORROR,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "It: A Novel",
+			KEY_LAST: "King", KEY_FIRST: "Stephen",
+			KEY_YEAR: 1986, KEY_GENRE: HORROR,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Frankenstein",
+			KEY_LAST: "Shelley", KEY_FIRST: "Mary",
+			KEY_YEAR: 1818, KEY_GENRE: HORROR,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "2001: A Space Odyssey",
+			KEY_LAST: "Clarke", KEY_FIRST: "Arthur",
+			KEY_YEAR: 1968, KEY_GENRE: SCIFI,
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Ender's Game",
+			KEY_LAST: "Card", KEY_FIRST: "Orson",
+			KEY_YEAR: 1985, KEY_GENRE: SCIFI,
+			KEY_ISBN: MustParseISBN("0812550706"),
+		},
+
+		{
+			KEY_KIND: FICTION, KEY_TITLE: "Good Omens",
+			KEY_LAST: []string{"Pratchett", "Gaiman"}, KEY_FIRST: []string{"Terry", "Neil"},
+			KEY_YEAR: 1990, KEY_GENRE: FANTASY,
+		},
+
+		// Cookbooks
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "The Wok of Life",
+			KEY_LAST: "Leung", KEY_FIRST: "Bill", KEY_REGION: CHINA,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Chinese Cooking for Dummies",
+			KEY_LAST: "Yan", KEY_FIRST: "Martin", KEY_REGION: CHINA,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Mastering the Art of French Cooking",
+			KEY_LAST: "Child", KEY_FIRST: "Julia", KEY_REGION: FRANCE,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Vegetarian India",
+			KEY_LAST: "Jaffrey", KEY_FIRST: "Madhur", KEY_REGION: INDIA,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Made in India",
+			KEY_LAST: "Sodha", KEY_FIRST: "Meera", KEY_REGION: INDIA,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Essentials of Classic Italian Cooking",
+			KEY_LAST: "Hazan", KEY_FIRST: "Marcella", KEY_REGION: ITALY,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "The Complete Italian Cookbook",
+			KEY_LAST: "Mazzocco", KEY_FIRST: "Manuela", KEY_REGION: ITALY,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Food for Life",
+			KEY_LAST: "Batmanglij", KEY_FIRST: "Najmieh", KEY_REGION: PERSIA,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "The New Orleans Kitchen",
+			KEY_LAST: "Devillier", KEY_FIRST: "Justin", KEY_REGION: US,
+		},
+
+		{
+			KEY_KIND: COOKBOOK, KEY_TITLE: "Rodney Scott's World of BBQ",
+			KEY_LAST: "Scott", KEY_FIRST: "Rodney", KEY_REGION: US,
+		},
+
+		// HowTo
+		{
+			KEY_KIND: HOWTO, KEY_TITLE: "On Writing: A Memoir of the Craft",
+			KEY_LAST: "King", KEY_FIRST: "Stephen", KEY_SUBJECT: WRITING,
+			KEY_ISBN: MustParseISBN("ISBN 0-684-85352-3"),
+		},
+	} {
+		if _, err := c.Add(MustAttributes(pairs)); err != nil {
+			return err
+		}
 	}
-	sort.Ints(keys)
+	return nil
+}
 
-	var sb strings.Builder
-	sb.WriteString("{")
-	for i, kInt := range keys {
-		if i > 0 {
-			sb.WriteString(", ")
+func search(c *Catalogue, q Query) {
+	fmt.Printf("\nFind %s\n", q)
+	matches := c.Find(q)
+	if len(matches) == 0 {
+		fmt.Println("No matches.")
+		if s, ok := c.DidYouMean(q); ok {
+			fmt.Printf("Did you mean %s?\n", s)
 		}
-		k := Key(kInt)
-		sb.WriteString(k.String() + ": ")
-
-		v := a.attrMap[k]
-		switch val := v.(type) {
-		case string:
-			sb.WriteString(fmt.Sprintf("'%s'", val))
-		case fmt.Stringer:
-			sb.WriteString(val.String())
-		default:
-			sb.WriteString(fmt.Sprintf("%v", val))
+	} else {
+		fmt.Println("Matches:")
+		for _, b := range matches {
+			fmt.Printf("  %s\n", b)
 		}
 	}
-	sb.WriteString("}")
-	return sb.String()
 }
 
-// ================= 3. BOOK & CATALOGUE =================
-type Book struct {
-	Attrs *Attributes
+// isbns parses each text as an ISBN and looks up the book carrying it.
+func isbns(c *Catalogue, texts ...string) {
+	for _, text := range texts {
+		fmt.Printf("\nISBN %q\n", text)
+		isbn, err := ParseISBN(text)
+		if err != nil {
+			fmt.Println(err)
+			continue
+		}
+		isbn10, ok := isbn.ISBN10()
+		if !ok {
+			isbn10 = "none"
+		}
+		fmt.Printf("ISBN-13 %s, ISBN-10 %s\n", isbn, isbn10)
+		if book, ok := c.ByISBN(isbn); ok {
+			fmt.Printf("  #%d %s\n", book.ID, book)
+		}
+	}
 }
 
-func (b Book) String() string { return b.Attrs.String() }
-
-type Catalogue struct {
-	booklist []*Book
+// duplicateISBN tries to add a book with the ISBN of an existing one and
+// to give a second book that ISBN.
+func duplicateISBN(c *Catalogue, isbn ISBN) {
+	fmt.Printf("\nAdd another book with ISBN %s\n", isbn)
+	_, err := c.Add(MustAttributes(M{
+		KEY_KIND: FICTION, KEY_TITLE: "Speaker for the Dead",
+		KEY_LAST: "Card", KEY_FIRST: "Orson", KEY_GENRE: SCIFI, KEY_ISBN: isbn,
+	}))
+	fmt.Println(err)
+	book := c.Books()[0]
+	fmt.Printf("\nUpdate #%d to ISBN %s\n", book.ID, isbn)
+	_, err = c.Update(book.ID, M{KEY_ISBN: isbn})
+	fmt.Println(err)
 }
 
-func (c *Catalogue) Add(attrs *Attributes) {
-	c.booklist = append(c.booklist, &Book{Attrs: attrs})
+func searchText(c *Catalogue, text string) {
+	q, err := ParseQuery(text)
+	if err != nil {
+		fmt.Printf("\nFind %s\n%v\n", text, err)
+		return
+	}
+	search(c, q)
 }
 
-func (c *Catalogue) Find(target *Attributes) []*Book {
-	var matches []*Book
-	for _, book := range c.booklist {
-		if book.Attrs.IsMatch(target) {
-			matches = append(matches, book)
-		}
+func searchWords(c *Catalogue, text string) {
+	fmt.Printf("\nSearch %q\n", text)
+	hits := c.Search(text, nil, 5)
+	if len(hits) == 0 {
+		fmt.Println("No matches.")
+	}
+	for _, hit := range hits {
+		fmt.Printf("  %s\n", hit)
 	}
-	return matches
 }
 
-// ================= 4. TESTER (MAIN) =================
-
-// Helper type alias to make the filling code cleaner
-type M map[Key]interface{}
-
-func main() {
-	catalogue := &Catalogue{}
-	fill(catalogue)
-	test(catalogue)
+func fuzzy(c *Catalogue, k Key, text string, maxDist int) {
+	fmt.Printf("\nFind %s within %d edits of %q\n", k, maxDist, text)
+	matches, err := c.FindFuzzy(k, text, maxDist)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, m := range matches {
+		fmt.Printf("  %s\n", m)
+	}
 }
 
-func fill(c *Catalogue) {
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "Life of Pi",
-		KEY_LAST: "Martel", KEY_FIRST: "Yann",
-		KEY_YEAR: 2003, KEY_GENRE: ADVENTURE,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "The Call of the Wild",
-		KEY_LAST: "London", KEY_FIRST: "Jack",
-		KEY_YEAR: 1903, KEY_GENRE: ADVENTURE,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "To Kill a Mockingbird",
-		KEY_LAST: "Lee", KEY_FIRST: "Harper",
-		KEY_YEAR: 1960, KEY_GENRE: CLASSICS,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "Little Women",
-		KEY_LAST: "Alcott", KEY_FIRST: "Louisa",
-		KEY_YEAR: 1868, KEY_GENRE: CLASSICS,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "The Adventures of Sherlock Holmes",
-		KEY_LAST: "Doyle", KEY_FIRST: "Conan",
-		KEY_YEAR: 1892, KEY_GENRE: DETECTIVE,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "And Then There Were None",
-		KEY_LAST: "Christie", KEY_FIRST: "Agatha",
-		KEY_YEAR: 1939, KEY_GENRE: DETECTIVE,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "Carrie",
-		KEY_LAST: "King", KEY_FIRST: "Stephen",
-		KEY_YEAR: 1974, KEY_GENRE: HORROR,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "It: A Novel",
-		KEY_LAST: "King", KEY_FIRST: "Stephen",
-		KEY_YEAR: 1986, KEY_GENRE: HORROR,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "Frankenstein",
-		KEY_LAST: "Shelley", KEY_FIRST: "Mary",
-		KEY_YEAR: 1818, KEY_GENRE: HORROR,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "2001: A Space Odyssey",
-		KEY_LAST: "Clarke", KEY_FIRST: "Arthur",
-		KEY_YEAR: 1968, KEY_GENRE: SCIFI,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: FICTION, KEY_TITLE: "Ender's Game",
-		KEY_LAST: "Card", KEY_FIRST: "Orson",
-		KEY_YEAR: 1985, KEY_GENRE: SCIFI,
-	}))
-
-	// Cookbooks
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "The Wok of Life",
-		KEY_LAST: "Leung", KEY_FIRST: "Bill", KEY_REGION: CHINA,
-	}))
-
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Chinese Cooking for Dummies",
-		KEY_LAST: "Yan", KEY_FIRST: "Martin", KEY_REGION: CHINA,
-	}))
+func facets(c *Catalogue, q Query, keys ...Key) {
+	if q == nil {
+		fmt.Println("\nFacets of every book")
+	} else {
+		fmt.Printf("\nFacets of %s\n", q)
+	}
+	facets, err := c.Facets(q, keys...)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, f := range facets {
+		fmt.Printf("  %s\n", f)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Mastering the Art of French Cooking",
-		KEY_LAST: "Child", KEY_FIRST: "Julia", KEY_REGION: FRANCE,
-	}))
+func report(c *Catalogue, k Key, q Query, format string) {
+	r, err := c.GroupReport(k, q)
+	if err != nil {
+		fmt.Printf("\nReport by %s\n%v\n", k, err)
+		return
+	}
+	fmt.Println()
+	if err := r.Write(os.Stdout, format); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Vegetarian India",
-		KEY_LAST: "Jaffrey", KEY_FIRST: "Madhur", KEY_REGION: INDIA,
-	}))
+func importCSV(c *Catalogue, text string) {
+	fmt.Println("\nImport CSV")
+	report, err := c.ImportCSV(strings.NewReader(text))
+	if err != nil {
+		fmt.Println(err)
+	}
+	if report != nil {
+		fmt.Println(report)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Made in India",
-		KEY_LAST: "Sodha", KEY_FIRST: "Meera", KEY_REGION: INDIA,
-	}))
+func exportCSV(c *Catalogue, q Query) {
+	fmt.Printf("\nExport %s as CSV\n", q)
+	if err := c.ExportCSV(os.Stdout, q); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Essentials of Classic Italian Cooking",
-		KEY_LAST: "Hazan", KEY_FIRST: "Marcella", KEY_REGION: ITALY,
-	}))
+func importReferences(c *Catalogue, format string, read func(io.Reader, map[Key]interface{}) (*ImportReport, error), text string, defaults M) {
+	fmt.Printf("\nImport %s\n", format)
+	report, err := read(strings.NewReader(text), defaults)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(report)
+	for _, id := range report.Added {
+		book, _ := c.Get(id)
+		fmt.Printf("  %s\n", book)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "The Complete Italian Cookbook",
-		KEY_LAST: "Mazzocco", KEY_FIRST: "Manuela", KEY_REGION: ITALY,
-	}))
+func exportReferences(c *Catalogue, q Query) {
+	fmt.Printf("\nExport %s as BibTeX\n", q)
+	if err := c.ExportBibTeX(os.Stdout, q); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Printf("\nExport %s as RIS\n", q)
+	var buf bytes.Buffer
+	if err := c.ExportRIS(&buf, q); err != nil {
+		fmt.Println(err)
+	}
+	fmt.Print(strings.ReplaceAll(buf.String(), "\r\n", "\n"))
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Food for Life",
-		KEY_LAST: "Batmanglij", KEY_FIRST: "Najmieh", KEY_REGION: PERSIA,
-	}))
+func exportDublinCore(c *Catalogue, q Query) {
+	fmt.Printf("\nExport %s as Dublin Core\n", q)
+	if err := c.ExportDublinCore(os.Stdout, q); err != nil {
+		fmt.Println(err)
+	}
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "The New Orleans Kitchen",
-		KEY_LAST: "Devillier", KEY_FIRST: "Justin", KEY_REGION: US,
-	}))
+func opds(c *Catalogue, k Key, value interface{}, search string) {
+	o := NewOPDS(c, "/opds")
+	o.Updated = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	o.PageSize = 2
+	fmt.Println("\nOPDS start feed")
+	writeXML(os.Stdout, o.Start())
+	fmt.Printf("\nOPDS navigation by %s\n", k)
+	nav, err := o.Navigation(k)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	writeXML(os.Stdout, nav)
+	fmt.Printf("\nOPDS books with %s %s\n", k, DefaultSchema.Format(k, value))
+	feed, err := o.ValueFeed(k, value, "")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	writeXML(os.Stdout, feed)
+	fmt.Printf("\nOPDS search for %q\n", search)
+	writeXML(os.Stdout, o.SearchFeed(search))
+}
 
-	c.Add(NewAttributes(M{
-		KEY_KIND: COOKBOOK, KEY_TITLE: "Rodney Scott's World of BBQ",
-		KEY_LAST: "Scott", KEY_FIRST: "Rodney", KEY_REGION: US,
-	}))
+// sampleMARC holds three records in ISO 2709, the last of them a score.
+const sampleMARC = "" +
+	"00281nam a2200097 i 4500001000700000008004100007100003400048245004900082260002900131650002300160\x1emc0001\x1e850723s1846    fr            000 1 fre d\x1e1 \x1faDumas, Alexandre,\x1fd1802-1870.\x1e14\x1faLe comte de Monte-Cristo /\x1fcAlexandre Dumas.\x1e  \x1faParis :\x1fbPétion,\x1fc1846.\x1e 0\x1faAdventure stories.\x1e\x1d" +
+	"00327nam a2200109 i 4500001000700000020001800007100004200025245005800067264003000125300004000155650002200195\x1emc0002\x1e  \x1fa9780714867526\x1e1 \x1faCarrillo Arronte, Margarita,\x1feauthor.\x1e10\x1faMexico :\x1fbthe cookbook /\x1fcMargarita Carrillo Arronte.\x1e 1\x1faLondon :\x1fbPhaidon,\x1fc2014.\x1e  \x1fa704 pages :\x1fbillustrations ;\x1fc27 cm\x1e 0\x1faCooking, Mexican.\x1e\x1d" +
+	"00095njm a2200049 i 4500001000700000245003800007\x1emc0003\x1e00\x1faGoldberg variations /\x1fcJ.S. Bach.\x1e\x1d"
+
+const sampleMARCXML = `<?xml version="1.0" encoding="UTF-8"?>
+<collection xmlns="http://www.loc.gov/MARC21/slim">
+  <record>
+    <leader>00000nam a2200000 i 4500</leader>
+    <controlfield tag="001">mx0001</controlfield>
+    <datafield tag="100" ind1="1" ind2=" ">
+      <subfield code="a">Stoker, Bram,</subfield>
+      <subfield code="d">1847-1912.</subfield>
+    </datafield>
+    <datafield tag="245" ind1="1" ind2="0">
+      <subfield code="a">Dracula /</subfield>
+      <subfield code="c">by Bram Stoker.</subfield>
+    </datafield>
+    <datafield tag="260" ind1=" " ind2=" ">
+      <subfield code="c">[1897]</subfield>
+    </datafield>
+    <datafield tag="650" ind1=" " ind2="0">
+      <subfield code="a">Vampires</subfield>
+      <subfield code="v">Fiction.</subfield>
+    </datafield>
+    <datafield tag="655" ind1=" " ind2="7">
+      <subfield code="a">Horror fiction.</subfield>
+    </datafield>
+  </record>
+  <record>
+    <leader>00000nam a2200000 i 4500</leader>
+    <controlfield tag="001">mx0002</controlfield>
+    <datafield tag="100" ind1="1" ind2=" ">
+      <subfield code="a">Gibson, William,</subfield>
+    </datafield>
+    <datafield tag="245" ind1="1" ind2="4">
+      <subfield code="a">The difference engine /</subfield>
+    </datafield>
+    <datafield tag="264" ind1=" " ind2="1">
+      <subfield code="c">c1990.</subfield>
+    </datafield>
+    <datafield tag="650" ind1=" " ind2="0">
+      <subfield code="a">Science fiction.</subfield>
+    </datafield>
+    <datafield tag="700" ind1="1" ind2=" ">
+      <subfield code="a">Sterling, Bruce.</subfield>
+    </datafield>
+  </record>
+  <record>
+    <leader>00000nam a2200000 i 4500</leader>
+    <controlfield tag="001">mx0003</controlfield>
+    <datafield tag="100" ind1="1" ind2=" ">
+      <subfield code="a">Joyce, James,</subfield>
+    </datafield>
+    <datafield tag="245" ind1="1" ind2="0">
+      <subfield code="a">Ulysses.</subfield>
+    </datafield>
+    <datafield tag="651" ind1=" " ind2="0">
+      <subfield code="a">Dublin (Ireland)</subfield>
+      <subfield code="v">Fiction.</subfield>
+    </datafield>
+  </record>
+</collection>
+`
+
+func importMARC(c *Catalogue, format string, read func(io.Reader) ([]*MARCRecord, error), data string) {
+	fmt.Printf("\nImport %s\n", format)
+	records, err := read(strings.NewReader(data))
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	// Records without a subject heading naming their Kind are fiction.
+	m := &MARCMapping{Rules: DefaultMARCMapping.Rules, Defaults: map[Key]interface{}{KEY_KIND: FICTION}}
+	report, err := c.ImportMARC(records, m)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println(report)
+	for _, id := range report.Added {
+		book, _ := c.Get(id)
+		fmt.Printf("  %s\n", book)
+	}
+}
 
-	// HowTo
-	c.Add(NewAttributes(M{
-		KEY_KIND: HOWTO, KEY_TITLE: "On Writing: A Memoir of the Craft",
-		KEY_LAST: "King", KEY_FIRST: "Stephen", KEY_SUBJECT: WRITING,
-	}))
+// transliterated fills a second catalogue with transliteration turned on
+// and runs the queries against it.
+func transliterated(texts ...string) {
+	c := NewCatalogue(Folding{Transliterate: true})
+	if err := fill(c); err != nil {
+		fmt.Println(err)
+		return
+	}
+	for _, text := range texts {
+		searchText(c, text)
+	}
 }
 
-func search(c *Catalogue, target *Attributes) {
-	fmt.Printf("\nFind %s\n", target)
-	matches := c.Find(target)
-	if len(matches) == 0 {
-		fmt.Println("No matches.")
-	} else {
-		fmt.Println("Matches:")
-		for _, b := range matches {
+// searchPages prints the sorted results of q a page at a time, following
+// the cursors.
+func searchPages(c *Catalogue, q Query, order string, limit int) {
+	keys, err := ParseSort(order)
+	if err != nil {
+		fmt.Printf("\nSort %s\n%v\n", order, err)
+		return
+	}
+	fmt.Printf("\nFind %s sorted by %s, %d per page\n", q, order, limit)
+	opts := FindOptions{Sort: keys, Limit: limit}
+	for n := 1; ; n++ {
+		page, err := c.FindPage(q, opts)
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		fmt.Printf("Page %d (books %d-%d of %d):\n", n, page.Offset+1, page.Offset+len(page.Books), page.Total)
+		for _, b := range page.Books {
 			fmt.Printf("  %s\n", b)
 		}
+		if page.Next == "" {
+			return
+		}
+		opts.Cursor = page.Next
 	}
 }
 
-func test(c *Catalogue) {
-	search(c, NewAttributes(M{
+// demo prints what the catalogue makes of a tour of queries, imports and
+// exports. The checks live in the _test.go files.
+func demo(c *Catalogue) {
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_TITLE: "Life of Pi",
 		KEY_LAST: "Martel", KEY_FIRST: "Yann",
 		KEY_YEAR: 2003, KEY_GENRE: ADVENTURE,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_LAST: "KING", KEY_GENRE: HORROR,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_TITLE: "1984",
 		KEY_LAST: "Orwell", KEY_FIRST: "George", KEY_GENRE: CLASSICS,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_YEAR: 1960, KEY_GENRE: ROMANCE,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_YEAR: 1960,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION, KEY_GENRE: SCIFI,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: FICTION,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: COOKBOOK, KEY_TITLE: "Mastering the Art of French Cooking",
 		KEY_LAST: "Child", KEY_FIRST: "Julia", KEY_REGION: FRANCE,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_REGION: CHINA,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: COOKBOOK, KEY_LAST: "Leung", KEY_REGION: MEXICO,
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_KIND: COOKBOOK, KEY_LAST: "Scott", KEY_FIRST: "Rodney",
 	}))
 
-	search(c, NewAttributes(M{
+	search(c, MustAttributes(M{
 		KEY_LAST: "King",
 	}))
+
+	search(c, And{
+		MustAttributes(M{KEY_KIND: FICTION}),
+		MustWhere(KEY_YEAR, OP_BETWEEN, 1900, 1970),
+	})
+
+	search(c, MustWhere(KEY_YEAR, OP_LT, 1900))
+
+	search(c, MustWhere(KEY_GENRE, OP_IN, DETECTIVE, SCIFI))
+
+	search(c, Or{
+		MustAttributes(M{KEY_LAST: "King"}),
+		MustAttributes(M{KEY_LAST: "Christie"}),
+	})
+
+	search(c, And{
+		MustAttributes(M{KEY_GENRE: HORROR}),
+		Not{MustAttributes(M{KEY_LAST: "King"})},
+	})
+
+	search(c, And{
+		MustAttributes(M{KEY_KIND: COOKBOOK}),
+		Or{MustAttributes(M{KEY_REGION: CHINA}), MustAttributes(M{KEY_REGION: INDIA})},
+	})
+
+	searchText(c, "kind:fiction genre:horror last:king year>=1980")
+	searchText(c, `title:"life of pi" OR (last:christie -genre:horror)`)
+	searchText(c, "kind:cookbook region:china,india")
+	searchText(c, "year:1900..1970 NOT genre:classics")
+	searchText(c, "genre:poetry")
+
+	search(c, MustAttributes(M{KEY_LAST: "gaiman"}))
+	search(c, MustAttributes(M{KEY_LAST: []string{"Gaiman", "Pratchett"}}))
+	searchText(c, "last:pratchett,king genre:fantasy,horror")
+
+	searchWords(c, "space odyssey")
+	searchWords(c, "the italian cookbooks")
+
+	search(c, MustAttributes(M{KEY_LAST: "Shelly"}))
+	search(c, Or{MustAttributes(M{KEY_LAST: "Christy"}), MustAttributes(M{KEY_TITLE: "the wok of lfie"})})
+	searchText(c, "last:kink~ genre:horror")
+	fuzzy(c, KEY_LAST, "Kinf", 2)
+
+	search(c, MustWhere(KEY_TITLE, OP_PREFIX, "life"))
+	searchText(c, "title~cook kind:cookbook")
+	searchText(c, "title:the* OR last:?ing")
+	searchText(c, `title:/\b(it|wild)\b/`)
+	searchText(c, `title:"mastering*"`)
+	searchText(c, "region~ind")
+
+	searchPages(c, MustAttributes(M{KEY_KIND: FICTION}), "-year,last", 4)
+	searchPages(c, MustAttributes(M{KEY_KIND: COOKBOOK}), "region,title", 5)
+
+	search(c, MustAttributes(M{KEY_FIRST: "emile"}))
+	search(c, MustAttributes(M{KEY_TITLE: "The\u0301re\u0300se Raquin"}))
+	searchText(c, "title:therese* OR last:чехов")
+	searchWords(c, "therese")
+	searchPages(c, MustAttributes(M{KEY_GENRE: CLASSICS}), "first", 10)
+
+	facets(c, nil, KEY_KIND, KEY_YEAR)
+	facets(c, MustAttributes(M{KEY_KIND: FICTION}), KEY_GENRE, KEY_YEAR, KEY_LAST)
+	facets(c, MustAttributes(M{KEY_KIND: COOKBOOK}), KEY_REGION)
+
+	report(c, KEY_KIND, nil, "text")
+	report(c, KEY_GENRE, nil, "text")
+	report(c, KEY_LAST, MustWhere(KEY_YEAR, OP_LT, 1950), "text")
+	report(c, KEY_REGION, MustAttributes(M{KEY_KIND: COOKBOOK}), "csv")
+	report(c, KEY_SUBJECT, nil, "json")
+
+	formats()
+	transliterated("last:chekhov", "title~sobach")
+}
+
+// formats runs the import and export examples against a catalogue of its
+// own, so the books they add never reach the one saved with -db.
+func formats() {
+	c := &Catalogue{}
+	if err := fill(c); err != nil {
+		fmt.Println(err)
+		return
+	}
+	importCSV(c, `kind,title,last,first,year,genre,region
+fiction,Neuromancer,Gibson,William,1984,scifi,
+fiction,"Do Androids Dream of Electric Sheep?",Dick,Philip,1968,SciFi,
+fiction,The Talisman,King;Straub,Stephen;Peter,1984,horror,
+cookbook,Plenty,Ottolenghi,Yotam,2010,,Persia
+fiction,Dune,Herbert,Frank,nineteen65,scifi,
+fiction,Rebecca,du Maurier,Daphne,1938,gothic,
+cookbook,Salt Fat Acid Heat,Nosrat,Samin,2017,,
+fiction,"Unclosed quote,Nobody,,,,
+`)
+	exportCSV(c, MustAttributes(M{KEY_LAST: "King"}))
+	importMARC(c, "ISO 2709", ReadMARC, sampleMARC)
+	importMARC(c, "MARCXML", ReadMARCXML, sampleMARCXML)
+
+	importReferences(c, "BibTeX", c.ImportBibTeX, `@string{pub = "Gollancz"}
+
+@book{herbert65,
+  title = {Dune},
+  author = {Herbert, Frank},
+  publisher = pub,
+  year = 1965,
+  keywords = {scifi}
+}
+
+@Book{maupassant,
+  title     = "Bel-{A}mi",
+  author    = {Guy de Maupassant},
+  year      = {1885},
+  keywords  = {fiction, classics}
+}
+
+@article{turing50,
+  title = {Computing Machinery and Intelligence},
+  author = {Turing, A. M.},
+  year = 1950
+}
+
+@book{broken,
+  title = {Missing a brace,
+  year = 2001
+}
+
+@book{garcia,
+  title = {Cien a{\~n}os de soledad},
+  author = {Garc{\'\i}a M{\'a}rquez, Gabriel},
+  year = {1967}
+}
+`, M{KEY_KIND: FICTION, KEY_GENRE: HISTORIC})
+	importReferences(c, "RIS", c.ImportRIS, "TY  - BOOK\nTI  - The Food of Sichuan\nAU  - Dunlop, Fuchsia\nPY  - 2019///\n"+
+		"KW  - cookbook\nKW  - China\nER  - \n\nTY  - JOUR\nTI  - A Paper\nER  - \n\nTY  - BOOK\nTI  - Untitled draft\n", nil)
+	exportReferences(c, MustAttributes(M{KEY_LAST: "King"}))
+	exportDublinCore(c, MustAttributes(M{KEY_LAST: "Dumas"}))
+	opds(c, KEY_REGION, CHINA, "monte cristo")
+
+	isbns(c, "0-8070-1429-X", "978-0-15-602732-8", "ISBN-10: 0-684-85352-3", "979-10-90636-07-1",
+		"0-15-602732-2", "12345")
+	searchText(c, `isbn:"0-06-112008-1"`)
+	search(c, MustWhere(KEY_ISBN, OP_IN, MustParseISBN("0156027321"), MustParseISBN("0812550706")))
+	duplicateISBN(c, MustParseISBN("0-8125-5070-6"))
+	importCSV(c, `KIND,TITLE,LAST,FIRST,YEAR,GENRE,ISBN
+fiction,Xenocide,Card,Orson,1991,scifi,0-312-86187-7
+fiction,Ender's Game,Card,Orson,1985,scifi,978-0-8125-5070-2
+fiction,Bad Checksum,Nobody,,2000,scifi,0-312-86187-6
+`)
 }
@@ -0,0 +1,14 @@
+// program4 is the only program here that needs packages beyond the
+// standard library, so it is the only one with a module: golang.org/x/text
+// normalizes and collates Unicode text, and golang.org/x/term switches the
+// shell's terminal to raw mode.
+module program4
+
+go 1.27.1
+
+require (
+	golang.org/x/term v0.46.0
+	golang.org/x/text v0.42.0
+)
+
+require golang.org/x/sys v0.48.0 // indirect
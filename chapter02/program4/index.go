@@ -0,0 +1,188 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Index maps every attribute value to the ascending IDs of the books
+// carrying it. Enum and int values are hashed as they are; strings are
+// case-folded so lookups agree with IsMatch. A book is listed under each
+// value of a multi-valued key. The words of free-text keys are indexed
+// separately in text, and ISBNs, which no two books share, in isbns.
+type Index struct {
+	folding  Folding // how strings become terms
+	postings map[Key]map[interface{}][]int
+	ids      []int // every indexed book
+	text     TextIndex
+	isbns    map[ISBN]int
+}
+
+// add indexes a new book, whose ID must be higher than any before it.
+func (ix *Index) add(id int, attrs *Attributes) {
+	ix.ids = append(ix.ids, id)
+	ix.addTerms(id, attrs)
+	ix.text.add(ix.folding, id, attrs)
+	ix.addISBN(id, attrs)
+}
+
+func (ix *Index) update(id int, old, attrs *Attributes) {
+	ix.removeTerms(id, old)
+	ix.text.remove(ix.folding, id, old)
+	ix.removeISBN(id, old)
+	ix.addTerms(id, attrs)
+	ix.text.add(ix.folding, id, attrs)
+	ix.addISBN(id, attrs)
+}
+
+func (ix *Index) remove(id int, attrs *Attributes) {
+	ix.removeTerms(id, attrs)
+	ix.text.remove(ix.folding, id, attrs)
+	ix.removeISBN(id, attrs)
+	ix.ids = without(ix.ids, id)
+}
+
+func (ix *Index) addISBN(id int, attrs *Attributes) {
+	isbn, ok := attrs.attrMap[KEY_ISBN].(ISBN)
+	if !ok {
+		return
+	}
+	if ix.isbns == nil {
+		ix.isbns = map[ISBN]int{}
+	}
+	ix.isbns[isbn] = id
+}
+
+func (ix *Index) removeISBN(id int, attrs *Attributes) {
+	if isbn, ok := attrs.attrMap[KEY_ISBN].(ISBN); ok && ix.isbns[isbn] == id {
+		delete(ix.isbns, isbn)
+	}
+}
+
+// duplicate returns the error for attrs when another book than id carries
+// its ISBN.
+func (ix *Index) duplicate(id int, attrs *Attributes) error {
+	isbn, ok := attrs.attrMap[KEY_ISBN].(ISBN)
+	if !ok {
+		return nil
+	}
+	if other, taken := ix.isbns[isbn]; taken && other != id {
+		return &DuplicateError{ISBN: isbn, ID: other}
+	}
+	return nil
+}
+
+func (ix *Index) addTerms(id int, attrs *Attributes) {
+	if ix.postings == nil {
+		ix.postings = map[Key]map[interface{}][]int{}
+	}
+	for k := range attrs.attrMap {
+		terms := ix.postings[k]
+		if terms == nil {
+			terms = map[interface{}][]int{}
+			ix.postings[k] = terms
+		}
+		for _, v := range attrs.values(k) {
+			term := ix.folding.term(v)
+			list := terms[term]
+			i := sort.SearchInts(list, id)
+			switch {
+			case i < len(list) && list[i] == id:
+				continue // two values with the same term
+			case i == len(list):
+				list = append(list, id)
+			default:
+				list = append(append(append([]int(nil), list[:i]...), id), list[i:]...)
+			}
+			terms[term] = list
+		}
+	}
+}
+
+func (ix *Index) removeTerms(id int, attrs *Attributes) {
+	for k := range attrs.attrMap {
+		for _, v := range attrs.values(k) {
+			term := ix.folding.term(v)
+			if list := without(ix.postings[k][term], id); len(list) == 0 {
+				delete(ix.postings[k], term)
+			} else {
+				ix.postings[k][term] = list
+			}
+		}
+	}
+}
+
+// without returns a copy of an ascending list with id left out.
+func without(list []int, id int) []int {
+	i := sort.SearchInts(list, id)
+	if i == len(list) || list[i] != id {
+		return list
+	}
+	return append(list[:i:i], list[i+1:]...)
+}
+
+func (ix *Index) lookup(k Key, v interface{}) []int {
+	return ix.postings[k][ix.folding.term(v)]
+}
+
+// all returns the ID of every book.
+func (ix *Index) all() []int { return ix.ids }
+
+// term is the index term of a value: strings in their folded form, other
+// values as they are.
+func (f Folding) term(v interface{}) interface{} {
+	if s, ok := v.(string); ok {
+		return f.key(s)
+	}
+	return v
+}
+
+// foldCase maps every rune to the smallest rune it is case-equivalent to,
+// so two strings fold alike exactly when strings.EqualFold reports them equal.
+func foldCase(s string) string {
+	return strings.Map(func(r rune) rune {
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		return min
+	}, s)
+}
+
+// intersect merges two ascending posting lists.
+func intersect(a, b []int) []int {
+	var out []int
+	for i, j := 0, 0; i < len(a) && j < len(b); {
+		switch {
+		case a[i] < b[j]:
+			i++
+		case a[i] > b[j]:
+			j++
+		default:
+			out = append(out, a[i])
+			i++
+			j++
+		}
+	}
+	return out
+}
+
+// union merges posting lists into one ascending list without duplicates.
+func union(lists [][]int) []int {
+	var out []int
+	for _, list := range lists {
+		out = append(out, list...)
+	}
+	sort.Ints(out)
+	n := 0
+	for i, id := range out {
+		if i == 0 || id != out[n-1] {
+			out[n] = id
+			n++
+		}
+	}
+	return out[:n]
+}
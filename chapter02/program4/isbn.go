@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// ISBN is an International Standard Book Number in its 13-digit form,
+// without hyphens. ISBN-10s are converted when parsed. Where the hyphens
+// go depends on the registration group and publisher, so they are not
+// kept.
+type ISBN string
+
+// isbnPrefix matches a leading "ISBN", "ISBN-13:" or the like.
+var isbnPrefix = regexp.MustCompile(`(?i)^isbn(-?1[03])?:?\s*`)
+
+// ParseISBN reads an ISBN-10 or ISBN-13, ignoring hyphens, spaces and an
+// "ISBN" label, and checks its check digit.
+func ParseISBN(text string) (ISBN, error) {
+	s := isbnPrefix.ReplaceAllString(strings.TrimSpace(text), "")
+	s = strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return unicode.ToUpper(r)
+	}, s)
+	switch {
+	case len(s) == 10 && isDigits(s[:9]) && (isDigits(s[9:]) || s[9] == 'X'):
+		if isbn10Check(s[:9]) != s[9] {
+			return "", fmt.Errorf("invalid ISBN %q: wrong check digit", text)
+		}
+		s = "978" + s[:9]
+		return ISBN(s + string(isbn13Check(s))), nil
+	case len(s) == 13 && isDigits(s):
+		if !strings.HasPrefix(s, "978") && !strings.HasPrefix(s, "979") {
+			return "", fmt.Errorf("invalid ISBN %q: ISBN-13s start with 978 or 979", text)
+		}
+		if isbn13Check(s[:12]) != s[12] {
+			return "", fmt.Errorf("invalid ISBN %q: wrong check digit", text)
+		}
+		return ISBN(s), nil
+	}
+	return "", fmt.Errorf("invalid ISBN %q: want 10 or 13 digits", text)
+}
+
+// MustParseISBN is like ParseISBN but panics on an invalid ISBN.
+func MustParseISBN(text string) ISBN {
+	isbn, err := ParseISBN(text)
+	if err != nil {
+		panic(err)
+	}
+	return isbn
+}
+
+func (i ISBN) String() string { return string(i) }
+
+// ISBN10 returns the 10-digit form. ISBNs starting with 979 have none.
+func (i ISBN) ISBN10() (string, bool) {
+	if !i.valid() || !strings.HasPrefix(string(i), "978") {
+		return "", false
+	}
+	s := string(i[3:12])
+	return s + string(isbn10Check(s)), true
+}
+
+// valid reports whether i is in the form ParseISBN returns.
+func (i ISBN) valid() bool {
+	parsed, err := ParseISBN(string(i))
+	return err == nil && parsed == i
+}
+
+// isbn10Check weighs the nine digits 10 down to 2; the check digit, X for
+// ten, makes the sum a multiple of 11.
+func isbn10Check(digits string) byte {
+	sum := 0
+	for i := 0; i < 9; i++ {
+		sum += (10 - i) * int(digits[i]-'0')
+	}
+	check := (11 - sum%11) % 11
+	if check == 10 {
+		return 'X'
+	}
+	return byte('0' + check)
+}
+
+// isbn13Check weighs the twelve digits alternately 1 and 3; the check
+// digit makes the sum a multiple of 10.
+func isbn13Check(digits string) byte {
+	sum := 0
+	for i := 0; i < 12; i++ {
+		sum += (1 + 2*(i%2)) * int(digits[i]-'0')
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// DuplicateError is returned for a book whose ISBN another book already
+// carries.
+type DuplicateError struct {
+	ISBN ISBN
+	ID   int // the book that has it
+}
+
+func (e *DuplicateError) Error() string {
+	return fmt.Sprintf("ISBN %s already belongs to book %d", e.ISBN, e.ID)
+}
@@ -0,0 +1,45 @@
+package main
+
+import "testing"
+
+func TestParseISBN(t *testing.T) {
+	for _, test := range []struct {
+		text   string
+		want   ISBN
+		isbn10 string
+	}{
+		{"0-15-602732-1", "9780156027328", "0156027321"},
+		{"ISBN 0 15 602732 1", "9780156027328", "0156027321"},
+		{"isbn-10: 0-8044-2957-x", "9780804429573", "080442957X"},
+		{"978-0-8044-2957-3", "9780804429573", "080442957X"},
+		{" ISBN-13: 9780156027328 ", "9780156027328", "0156027321"},
+		{"979-10-90636-07-1", "9791090636071", ""},
+	} {
+		got, err := ParseISBN(test.text)
+		if err != nil || got != test.want {
+			t.Errorf("ParseISBN(%q) = %q, %v; want %q", test.text, got, err, test.want)
+			continue
+		}
+		isbn10, ok := got.ISBN10()
+		if isbn10 != test.isbn10 || ok != (test.isbn10 != "") {
+			t.Errorf("%s.ISBN10() = %q, %v; want %q", got, isbn10, ok, test.isbn10)
+		}
+	}
+}
+
+func TestParseISBNErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"12345",
+		"0-15-602732-2",
+		"978-0-15-602732-9",
+		"977-0-15-602732-8",
+		"0-15-60273X-1",
+		"97801560273281",
+		"ISBN",
+	} {
+		if isbn, err := ParseISBN(text); err == nil {
+			t.Errorf("ParseISBN(%q) = %q, want an error", text, isbn)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MARCRecord is a MARC 21 bibliographic record, read from ISO 2709 or
+// MARCXML.
+type MARCRecord struct {
+	Leader string
+	Fields []MARCField
+}
+
+// MARCField is a control field (tags 001 to 009), which has a Value, or a
+// data field, which has indicators and subfields.
+type MARCField struct {
+	Tag        string
+	Ind1, Ind2 byte
+	Value      string
+	Subfields  []MARCSubfield
+}
+
+type MARCSubfield struct {
+	Code  byte
+	Value string
+}
+
+// ControlNumber returns field 001, which identifies the record to its sender.
+func (r *MARCRecord) ControlNumber() string {
+	for _, f := range r.Fields {
+		if f.Tag == "001" {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// text joins the subfields with the given codes in the order they appear,
+// or all of them if codes is empty. A control field gives its value.
+func (f *MARCField) text(codes string) string {
+	if f.Subfields == nil {
+		return f.Value
+	}
+	var parts []string
+	for _, sf := range f.Subfields {
+		if codes == "" || strings.IndexByte(codes, sf.Code) >= 0 {
+			parts = append(parts, sf.Value)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+const (
+	marcSubfield   = 0x1F
+	marcFieldEnd   = 0x1E
+	marcRecordEnd  = 0x1D
+	marcLeaderLen  = 24
+	marcEntryLen   = 12
+	marcUTF8Scheme = 'a' // leader position 9
+)
+
+// ReadMARC reads records in ISO 2709 interchange format. Records must be
+// in UTF-8; MARC-8 is accepted only when it is plain ASCII.
+func ReadMARC(r io.Reader) ([]*MARCRecord, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	var records []*MARCRecord
+	for n := 1; ; n++ {
+		if data = bytes.TrimLeft(data, " \r\n"); len(data) == 0 {
+			return records, nil
+		}
+		length, err := strconv.Atoi(string(data[:min(5, len(data))]))
+		if err != nil || length < marcLeaderLen || length > len(data) {
+			return records, fmt.Errorf("marc record %d: bad record length %q", n, data[:min(5, len(data))])
+		}
+		rec, err := parseMARC(data[:length])
+		if err != nil {
+			return records, fmt.Errorf("marc record %d: %v", n, err)
+		}
+		records = append(records, rec)
+		data = data[length:]
+	}
+}
+
+func parseMARC(data []byte) (*MARCRecord, error) {
+	if data[len(data)-1] != marcRecordEnd {
+		return nil, errors.New("missing record terminator")
+	}
+	leader := string(data[:marcLeaderLen])
+	if leader[9] != marcUTF8Scheme && !isASCII(string(data)) {
+		return nil, errors.New("MARC-8 encoding is not supported")
+	}
+	base, err := strconv.Atoi(leader[12:17])
+	if err != nil || base <= marcLeaderLen || base > len(data) || data[base-1] != marcFieldEnd {
+		return nil, fmt.Errorf("bad base address %q", leader[12:17])
+	}
+	dir := data[marcLeaderLen : base-1]
+	if len(dir)%marcEntryLen != 0 {
+		return nil, errors.New("bad directory length")
+	}
+	rec := &MARCRecord{Leader: leader}
+	for i := 0; i < len(dir); i += marcEntryLen {
+		entry := string(dir[i : i+marcEntryLen])
+		length, err1 := strconv.Atoi(entry[3:7])
+		start, err2 := strconv.Atoi(entry[7:12])
+		if err1 != nil || err2 != nil || length <= 0 || start < 0 || base+start+length > len(data) {
+			return nil, fmt.Errorf("bad directory entry %q", entry)
+		}
+		body := data[base+start : base+start+length]
+		if body[len(body)-1] != marcFieldEnd {
+			return nil, fmt.Errorf("field %s: missing field terminator", entry[:3])
+		}
+		body = body[:len(body)-1]
+		f := MARCField{Tag: entry[:3]}
+		if strings.HasPrefix(f.Tag, "00") {
+			f.Value = string(body)
+		} else {
+			if len(body) < 2 {
+				return nil, fmt.Errorf("field %s: missing indicators", f.Tag)
+			}
+			f.Ind1, f.Ind2 = body[0], body[1]
+			f.Subfields = []MARCSubfield{}
+			for _, sf := range bytes.Split(body[2:], []byte{marcSubfield})[1:] {
+				if len(sf) > 0 {
+					f.Subfields = append(f.Subfields, MARCSubfield{Code: sf[0], Value: string(sf[1:])})
+				}
+			}
+		}
+		rec.Fields = append(rec.Fields, f)
+	}
+	return rec, nil
+}
+
+type marcXMLRecord struct {
+	Leader  string `xml:"leader"`
+	Control []struct {
+		Tag   string `xml:"tag,attr"`
+		Value string `xml:",chardata"`
+	} `xml:"controlfield"`
+	Data []struct {
+		Tag       string `xml:"tag,attr"`
+		Ind1      string `xml:"ind1,attr"`
+		Ind2      string `xml:"ind2,attr"`
+		Subfields []struct {
+			Code  string `xml:"code,attr"`
+			Value string `xml:",chardata"`
+		} `xml:"subfield"`
+	} `xml:"datafield"`
+}
+
+// ReadMARCXML reads the record elements of a MARCXML document, whether a
+// collection or a single record.
+func ReadMARCXML(r io.Reader) ([]*MARCRecord, error) {
+	dec := xml.NewDecoder(r)
+	var records []*MARCRecord
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("marcxml: %v", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "record" {
+			continue
+		}
+		var x marcXMLRecord
+		if err := dec.DecodeElement(&x, &start); err != nil {
+			return records, fmt.Errorf("marcxml record %d: %v", len(records)+1, err)
+		}
+		rec := &MARCRecord{Leader: x.Leader}
+		for _, cf := range x.Control {
+			rec.Fields = append(rec.Fields, MARCField{Tag: cf.Tag, Value: cf.Value})
+		}
+		for _, df := range x.Data {
+			f := MARCField{Tag: df.Tag, Ind1: indicator(df.Ind1), Ind2: indicator(df.Ind2), Subfields: []MARCSubfield{}}
+			for _, sf := range df.Subfields {
+				f.Subfields = append(f.Subfields, MARCSubfield{Code: indicator(sf.Code), Value: sf.Value})
+			}
+			rec.Fields = append(rec.Fields, f)
+		}
+		records = append(records, rec)
+	}
+}
+
+func indicator(s string) byte {
+	if s == "" {
+		return ' '
+	}
+	return s[0]
+}
+
+// MARCRule takes a value for Key from each field with the given Tag. The
+// text of the listed subfields has its ISBD punctuation removed and is
+// then converted by the type of the key:
+//
+//   - strings are kept as they are, or with Name split at the first comma
+//     into LAST and FIRST, as in "King, Stephen,"
+//   - ints and ISBNs are parsed after Pattern, if any, picks out the
+//     number; an invalid ISBN yields nothing
+//   - enums take the value Values gives for the first of its phrases found
+//     among the words of the text, matched ignoring case and accents, or
+//     else the value named by the text itself
+//
+// A field whose text yields nothing is left for the next rule.
+type MARCRule struct {
+	Tag       string
+	Subfields string
+	Key       Key
+	Name      bool
+	Pattern   *regexp.Regexp
+	Values    map[string]string
+}
+
+// MARCMapping is the set of rules for importing MARC records. Defaults
+// fill in the keys no rule gives a value, like the defaults of
+// ImportBibTeX: a KIND among them is given to records no rule assigns one,
+// and the others only to books whose Kind may carry them.
+type MARCMapping struct {
+	Rules    []MARCRule
+	Defaults map[Key]interface{}
+}
+
+// yearPattern picks the year out of text such as "c1974." or "[1897?]".
+var yearPattern = regexp.MustCompile(`\d{4}`)
+
+// isbnPattern picks the ISBN out of text such as "0140449132 (pbk.) :".
+var isbnPattern = regexp.MustCompile(`\d[\d-]{8,15}[\dXx]`)
+
+var marcGenres = map[string]string{
+	"adventure": "adventure", "sea stories": "adventure", "classics": "classics",
+	"detective": "detective", "mystery": "detective", "fantasy": "fantasy",
+	"historical fiction": "historic", "horror": "horror", "ghost stories": "horror",
+	"love stories": "romance", "romance": "romance", "science fiction": "scifi",
+}
+
+// DefaultMARCMapping reads the title from 245 $a $b, authors from 100 and
+// 700 $a, the year from 260 or 264 $c, the ISBN from 020 $a, and Kind,
+// Genre, Region and Subject from the subject headings in 650 and the genre
+// terms in 655. It has no defaults, so a record without headings that
+// name its Kind is rejected.
+var DefaultMARCMapping = &MARCMapping{
+	Rules: []MARCRule{
+		{Tag: "245", Subfields: "ab", Key: KEY_TITLE},
+		{Tag: "100", Subfields: "a", Key: KEY_LAST, Name: true},
+		{Tag: "700", Subfields: "a", Key: KEY_LAST, Name: true},
+		{Tag: "260", Subfields: "c", Key: KEY_YEAR, Pattern: yearPattern},
+		{Tag: "264", Subfields: "c", Key: KEY_YEAR, Pattern: yearPattern},
+		{Tag: "020", Subfields: "a", Key: KEY_ISBN, Pattern: isbnPattern},
+		{Tag: "650", Subfields: "avx", Key: KEY_KIND, Values: map[string]string{
+			"cooking": "cookbook", "cookery": "cookbook", "recipes": "cookbook",
+			"fiction": "fiction", "technique": "howto", "authorship": "howto",
+		}},
+		{Tag: "655", Subfields: "a", Key: KEY_KIND, Values: map[string]string{
+			"cookbooks": "cookbook", "fiction": "fiction", "novels": "fiction",
+		}},
+		{Tag: "650", Subfields: "avx", Key: KEY_GENRE, Values: marcGenres},
+		{Tag: "655", Subfields: "a", Key: KEY_GENRE, Values: marcGenres},
+		{Tag: "650", Subfields: "az", Key: KEY_REGION, Values: map[string]string{
+			"chinese": "China", "china": "China", "french": "France", "france": "France",
+			"indic": "India", "indian": "India", "india": "India", "italian": "Italy",
+			"italy": "Italy", "mexican": "Mexico", "mexico": "Mexico", "iranian": "Persia",
+			"persian": "Persia", "iran": "Persia", "american": "US", "united states": "US",
+		}},
+		{Tag: "650", Subfields: "a", Key: KEY_SUBJECT, Values: map[string]string{
+			"drawing": "drawing", "painting": "painting", "authorship": "writing",
+			"creative writing": "writing",
+		}},
+	},
+}
+
+// MARCReport is the outcome of importing MARC records.
+type MARCReport struct {
+	Added    []int
+	Rejected []RecordError // Index is the record's position in the input
+	Unmapped map[string]int
+}
+
+func (r *MARCReport) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%d added, %d rejected", len(r.Added), len(r.Rejected))
+	for _, re := range r.Rejected {
+		fmt.Fprintf(&sb, "\n  record %d: %v", re.Index+1, re.Err)
+	}
+	if len(r.Unmapped) > 0 {
+		tags := make([]string, 0, len(r.Unmapped))
+		for tag := range r.Unmapped {
+			tags = append(tags, tag)
+		}
+		sort.Strings(tags)
+		for i, tag := range tags {
+			tags[i] = fmt.Sprintf("%s (%d)", tag, r.Unmapped[tag])
+		}
+		fmt.Fprintf(&sb, "\nunmapped fields: %s", strings.Join(tags, ", "))
+	}
+	return sb.String()
+}
+
+// ImportMARC adds a book for each record the mapping can make a valid book
+// of, using DefaultMARCMapping if m is nil, and counts by tag the fields
+// of the added records that gave no value. Values for keys the book's
+// Kind may not carry are dropped and their fields counted as unmapped.
+// Records whose ISBN is already taken are rejected.
+func (c *Catalogue) ImportMARC(records []*MARCRecord, m *MARCMapping) (*MARCReport, error) {
+	if m == nil {
+		m = DefaultMARCMapping
+	}
+	report := &MARCReport{Unmapped: map[string]int{}}
+	for i, rec := range records {
+		attrs, unmapped, err := m.attributes(rec)
+		if err != nil {
+			if id := rec.ControlNumber(); id != "" {
+				err = fmt.Errorf("%s: %v", id, err)
+			}
+			report.Rejected = append(report.Rejected, RecordError{Index: i, Err: err})
+			continue
+		}
+		id, err := c.add(attrs)
+		var dup *DuplicateError
+		if errors.As(err, &dup) {
+			if id := rec.ControlNumber(); id != "" {
+				err = fmt.Errorf("%s: %v", id, err)
+			}
+			report.Rejected = append(report.Rejected, RecordError{Index: i, Err: err})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		for _, tag := range unmapped {
+			report.Unmapped[tag]++
+		}
+		report.Added = append(report.Added, id)
+	}
+	return report, c.Sync()
+}
+
+// marcValue is a value a rule took from the field at index field.
+type marcValue struct {
+	field int
+	key   Key
+	value interface{}
+	name  bool
+	first string
+}
+
+// maps reports whether a rule reads fields with tag.
+func (m *MARCMapping) maps(tag string) bool {
+	for _, rule := range m.Rules {
+		if rule.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// attributes applies the mapping to a record and returns the tags of the
+// fields that gave no value.
+func (m *MARCMapping) attributes(rec *MARCRecord) (*Attributes, []string, error) {
+	if len(rec.Leader) == marcLeaderLen && !strings.ContainsRune("at", rune(rec.Leader[6])) {
+		return nil, nil, fmt.Errorf("record type %q is not a book", rec.Leader[6])
+	}
+	var values []marcValue
+	for i := range rec.Fields {
+		f := &rec.Fields[i]
+		for _, rule := range m.Rules {
+			if rule.Tag != f.Tag {
+				continue
+			}
+			text := isbdTrim(f.text(rule.Subfields))
+			if text == "" {
+				continue
+			}
+			v := marcValue{field: i, key: rule.Key, name: rule.Name}
+			if rule.Name {
+				last, first, _ := strings.Cut(text, ",")
+				v.value, v.first = isbdTrim(last), isbdTrim(first)
+			} else {
+				value, ok, err := rule.convert(text)
+				if err != nil {
+					return nil, nil, fmt.Errorf("field %s: %v", f.Tag, err)
+				}
+				if !ok {
+					continue
+				}
+				v.value = value
+			}
+			values = append(values, v)
+		}
+	}
+
+	dropped := map[Key]bool{}
+	for {
+		used := make([]bool, len(rec.Fields))
+		pairs := map[Key]interface{}{}
+		seen := map[Key]bool{}
+		var firsts []string
+		for _, v := range values {
+			if dropped[v.key] || (seen[v.key] && !DefaultSchema.multi(v.key)) {
+				continue
+			}
+			if !seen[v.key] {
+				pairs[v.key] = nil
+			}
+			seen[v.key] = true
+			used[v.field] = true
+			if DefaultSchema.multi(v.key) {
+				list, _ := pairs[v.key].([]interface{})
+				if !containsValue(list, v.value, Folding{}) {
+					pairs[v.key] = append(list, v.value)
+				}
+			} else {
+				pairs[v.key] = v.value
+			}
+			if v.name {
+				firsts = append(firsts, v.first)
+			}
+		}
+		// FIRST[i] goes with LAST[i], so first names are only kept if
+		// every author has one.
+		if len(firsts) > 0 && !dropped[KEY_FIRST] && !containsValue(listOf(firsts), "", Folding{}) {
+			list := make([]interface{}, len(firsts))
+			for i, first := range firsts {
+				list[i] = first
+			}
+			pairs[KEY_FIRST] = list
+		}
+		kind, ok := pairs[KEY_KIND].(Kind)
+		if !ok {
+			kind, _ = m.Defaults[KEY_KIND].(Kind)
+		}
+		for k, v := range m.Defaults {
+			if _, set := pairs[k]; !set && !dropped[k] && DefaultSchema.allows(kind, k) {
+				pairs[k] = v
+			}
+		}
+		attrs, err := NewAttributes(pairs)
+		if err != nil {
+			return nil, nil, err
+		}
+		var ke *KindError
+		if err := DefaultSchema.CheckBook(attrs); errors.As(err, &ke) && len(ke.Disallowed) > 0 && len(ke.Missing) == 0 {
+			for _, k := range ke.Disallowed {
+				dropped[k] = true
+			}
+			continue
+		} else if err != nil {
+			return nil, nil, err
+		}
+		var unmapped []string
+		for i, f := range rec.Fields {
+			if !used[i] && (!strings.HasPrefix(f.Tag, "00") || m.maps(f.Tag)) {
+				unmapped = append(unmapped, f.Tag)
+			}
+		}
+		return attrs, unmapped, nil
+	}
+}
+
+// convert turns the text of a field into a value for the rule's key.
+func (rule *MARCRule) convert(text string) (interface{}, bool, error) {
+	spec, ok := DefaultSchema.Spec(rule.Key)
+	if !ok {
+		return nil, false, fmt.Errorf("unknown key %s", rule.Key)
+	}
+	switch spec.Type {
+	case TYPE_STRING:
+		return text, true, nil
+	case TYPE_INT, TYPE_ISBN:
+		if rule.Pattern != nil {
+			if text = rule.Pattern.FindString(text); text == "" {
+				return nil, false, nil
+			}
+		}
+		v, err := DefaultSchema.Parse(rule.Key, text)
+		return v, err == nil, nil
+	}
+	if name, ok := phraseValue(rule.Values, text); ok {
+		v, err := DefaultSchema.Parse(rule.Key, name)
+		return v, err == nil, err
+	}
+	v, err := DefaultSchema.Parse(rule.Key, text)
+	return v, err == nil, nil
+}
+
+// phraseValue returns the value of the longest phrase in values that
+// appears as whole words in text.
+func phraseValue(values map[string]string, text string) (string, bool) {
+	words := " " + strings.Join(terms(text), " ") + " "
+	best, bestValue, found := "", "", false
+	for phrase, value := range values {
+		p := strings.Join(terms(phrase), " ")
+		if p == "" || !strings.Contains(words, " "+p+" ") {
+			continue
+		}
+		if !found || len(p) > len(best) || len(p) == len(best) && p < best {
+			best, found = p, true
+			bestValue = value
+		}
+	}
+	return bestValue, found
+}
+
+func terms(text string) []string {
+	var out []string
+	for _, w := range (Folding{}).tokenize(text) {
+		out = append(out, w.term)
+	}
+	return out
+}
+
+// isbdTrim removes the punctuation cataloguers put between and after
+// subfields: "Dune /" becomes "Dune", "Carrie : a novel" "Carrie: a novel".
+// A final full stop is kept after an initial, as in "Tolkien, J. R. R.".
+func isbdTrim(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	s = strings.NewReplacer(" : ", ": ", " ; ", "; ", " , ", ", ").Replace(s)
+	s = strings.TrimRight(s, " /:;,=")
+	if rest, ok := strings.CutSuffix(s, "."); ok && !endsWithInitial(rest) {
+		s = strings.TrimRight(rest, " /:;,=")
+	}
+	if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	return s
+}
+
+func endsWithInitial(s string) bool {
+	r, size := utf8.DecodeLastRuneInString(s)
+	if !unicode.IsUpper(r) {
+		return false
+	}
+	before, _ := utf8.DecodeLastRuneInString(s[:len(s)-size])
+	return before == utf8.RuneError || before == ' ' || before == '.'
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// marcBytes assembles an ISO 2709 record from raw directory entries and
+// the field data they point into, without checking either.
+func marcBytes(entries []string, fields string) []byte {
+	dir := strings.Join(entries, "") + "\x1e"
+	base := marcLeaderLen + len(dir)
+	leader := fmt.Sprintf("%05dnam a22%05d i 4500", base+len(fields)+1, base)
+	return []byte(leader + dir + fields + "\x1d")
+}
+
+func TestReadMARCMalformed(t *testing.T) {
+	const fields = "mc0001\x1e10\x1faDune\x1e"
+	for _, test := range []struct {
+		name    string
+		entries []string
+		err     string // "" if the record is valid
+	}{
+		{"valid", []string{"001000700000", "245000900007"}, ""},
+		{"negative length", []string{"001-00100000"}, "bad directory entry"},
+		{"negative start", []string{"0010007-0001"}, "bad directory entry"},
+		{"zero length", []string{"001000000000"}, "bad directory entry"},
+		{"past the end", []string{"001009900000"}, "bad directory entry"},
+		{"not a number", []string{"001000x00000"}, "bad directory entry"},
+		{"no field terminator", []string{"001000600000"}, "missing field terminator"},
+		{"no indicators", []string{"245000100015"}, "missing indicators"},
+	} {
+		records, err := ReadMARC(bytes.NewReader(marcBytes(test.entries, fields)))
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.err == "" && len(records) != 1:
+			t.Errorf("%s: %d records", test.name, len(records))
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+// encodeMARC writes rec in ISO 2709 under a leader made for it, which it
+// stores in rec.
+func encodeMARC(rec *MARCRecord, typ byte) []byte {
+	var dir, data strings.Builder
+	for _, f := range rec.Fields {
+		start := data.Len()
+		if f.Subfields == nil {
+			data.WriteString(f.Value)
+		} else {
+			data.WriteByte(f.Ind1)
+			data.WriteByte(f.Ind2)
+			for _, sf := range f.Subfields {
+				data.WriteString("\x1f" + string(sf.Code) + sf.Value)
+			}
+		}
+		data.WriteByte('\x1e')
+		fmt.Fprintf(&dir, "%s%04d%05d", f.Tag, data.Len()-start, start)
+	}
+	base := marcLeaderLen + dir.Len() + 1
+	rec.Leader = fmt.Sprintf("%05dn%cm a22%05d i 4500", base+data.Len()+1, typ, base)
+	return []byte(rec.Leader + dir.String() + "\x1e" + data.String() + "\x1d")
+}
+
+// encodeMARCXML writes rec as a MARCXML collection of one record.
+func encodeMARCXML(rec *MARCRecord) string {
+	var sb strings.Builder
+	sb.WriteString(`<collection xmlns="http://www.loc.gov/MARC21/slim"><record>`)
+	fmt.Fprintf(&sb, "<leader>%s</leader>", rec.Leader)
+	for _, f := range rec.Fields {
+		if f.Subfields == nil {
+			fmt.Fprintf(&sb, `<controlfield tag="%s">%s</controlfield>`, f.Tag, f.Value)
+			continue
+		}
+		fmt.Fprintf(&sb, `<datafield tag="%s" ind1="%c" ind2="%c">`, f.Tag, f.Ind1, f.Ind2)
+		for _, sf := range f.Subfields {
+			fmt.Fprintf(&sb, `<subfield code="%c">%s</subfield>`, sf.Code, sf.Value)
+		}
+		sb.WriteString("</datafield>")
+	}
+	sb.WriteString("</record></collection>")
+	return sb.String()
+}
+
+// marcData makes a data field; each subfield is its code followed by its
+// value.
+func marcData(tag, ind string, subfields ...string) MARCField {
+	f := MARCField{Tag: tag, Ind1: ind[0], Ind2: ind[1]}
+	for _, sf := range subfields {
+		f.Subfields = append(f.Subfields, MARCSubfield{Code: sf[0], Value: sf[1:]})
+	}
+	return f
+}
+
+// TestMARCRoundTrip writes records in both formats, reads them back and
+// imports them; the two formats must give the same fields and books.
+func TestMARCRoundTrip(t *testing.T) {
+	for _, test := range []struct {
+		typ    byte
+		fields []MARCField
+		want   string // the book, or the error rejecting it
+	}{
+		{'a', []MARCField{
+			{Tag: "001", Value: "mc0001"},
+			marcData("100", "1 ", "aDumas, Alexandre,", "d1802-1870."),
+			marcData("245", "14", "aLe comte de Monte-Cristo /", "cAlexandre Dumas."),
+			marcData("260", "  ", "aParis :", "bPétion,", "c1846."),
+			marcData("650", " 0", "aAdventure stories."),
+		}, "{KIND: fiction, TITLE: 'Le comte de Monte-Cristo', LAST: 'Dumas', FIRST: 'Alexandre', YEAR: 1846, GENRE: adventure}"},
+		{'a', []MARCField{
+			{Tag: "001", Value: "mc0002"},
+			marcData("020", "  ", "a9780714867526"),
+			marcData("100", "1 ", "aCarrillo Arronte, Margarita,", "eauthor."),
+			marcData("245", "10", "aMexico :", "bthe cookbook /"),
+			marcData("264", " 1", "c2014."),
+			marcData("650", " 0", "aCooking, Mexican."),
+		}, "{KIND: cookbook, TITLE: 'Mexico: the cookbook', LAST: 'Carrillo Arronte', FIRST: 'Margarita', YEAR: 2014, REGION: Mexico, ISBN: 9780714867526}"},
+		{'t', []MARCField{
+			marcData("100", "1 ", "aGibson, William,"),
+			marcData("245", "14", "aThe difference engine /"),
+			marcData("264", " 1", "cc1990."),
+			marcData("650", " 0", "aScience fiction."),
+			marcData("700", "1 ", "aSterling, Bruce."),
+		}, "{KIND: fiction, TITLE: 'The difference engine', LAST: ['Gibson', 'Sterling'], FIRST: ['William', 'Bruce'], YEAR: 1990, GENRE: scifi}"},
+		{'j', []MARCField{
+			{Tag: "001", Value: "mc0003"},
+			marcData("245", "00", "aGoldberg variations /", "cJ.S. Bach."),
+		}, "mc0003: record type 'j' is not a book"},
+		{'a', []MARCField{
+			marcData("100", "1 ", "aJoyce, James,"),
+			marcData("245", "10", "aUlysses."),
+		}, "fiction missing GENRE"},
+	} {
+		rec := &MARCRecord{Fields: test.fields}
+		iso := encodeMARC(rec, test.typ)
+		fromISO, err := ReadMARC(bytes.NewReader(iso))
+		if err != nil {
+			t.Fatalf("ReadMARC(%q): %v", iso, err)
+		}
+		fromXML, err := ReadMARCXML(strings.NewReader(encodeMARCXML(rec)))
+		if err != nil {
+			t.Fatalf("ReadMARCXML: %v", err)
+		}
+		for format, got := range map[string][]*MARCRecord{"ISO 2709": fromISO, "MARCXML": fromXML} {
+			if len(got) != 1 || !reflect.DeepEqual(got[0], rec) {
+				t.Errorf("%s read back %+v, want %+v", format, got, rec)
+				continue
+			}
+			c := &Catalogue{}
+			m := &MARCMapping{Rules: DefaultMARCMapping.Rules, Defaults: map[Key]interface{}{KEY_KIND: FICTION}}
+			report, err := c.ImportMARC(got, m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var result string
+			if len(report.Added) == 1 {
+				book, _ := c.Get(report.Added[0])
+				result = book.String()
+			} else if len(report.Rejected) == 1 {
+				result = report.Rejected[0].Err.Error()
+			}
+			if result != test.want {
+				t.Errorf("%s imported %q, want %q", format, result, test.want)
+			}
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Folding sets how strings are made comparable for matching, indexing and
+// sorting. Case is always ignored and composed and decomposed forms of a
+// letter (é as one rune or as e and a combining accent) always compare
+// equal. The zero Folding also ignores accents. A catalogue is given its
+// Folding by NewCatalogue or OpenCatalogue and keeps it.
+type Folding struct {
+	KeepDiacritics bool // match accents exactly, so "Émile" does not match "Emile"
+	Transliterate  bool // spell Greek and Cyrillic in Latin letters, so "Чехов" matches "Chekhov"
+}
+
+// key is the form strings are indexed and compared in.
+func (f Folding) key(s string) string {
+	return foldCase(f.Fold(s))
+}
+
+// Fold applies the folding to s, leaving case alone, and returns it in NFC.
+func (f Folding) Fold(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	if f.KeepDiacritics && !f.Transliterate {
+		return norm.NFC.String(s)
+	}
+	var sb strings.Builder
+	for _, r := range norm.NFD.String(s) {
+		if !f.KeepDiacritics {
+			if unicode.Is(unicode.Mn, r) {
+				continue
+			}
+			if rep, ok := unaccented[r]; ok {
+				sb.WriteString(rep)
+				continue
+			}
+		}
+		if f.Transliterate {
+			if rep, ok := latinSpelling[r]; ok {
+				sb.WriteString(rep)
+				continue
+			}
+		}
+		sb.WriteRune(r)
+	}
+	return norm.NFC.String(sb.String())
+}
+
+// composed returns v with its strings, and those of a list, in NFC, the
+// form the catalogue stores them in.
+func composed(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return norm.NFC.String(v)
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, elem := range v {
+			list[i] = composed(elem)
+		}
+		return list
+	}
+	return v
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// unaccented spells the letters that carry a diacritic but have no
+// decomposition.
+var unaccented = map[rune]string{
+	'ß': "ss", 'ẞ': "SS", 'æ': "ae", 'Æ': "AE", 'œ': "oe", 'Œ': "OE",
+	'ø': "o", 'Ø': "O", 'ł': "l", 'Ł': "L", 'đ': "d", 'Đ': "D",
+	'ð': "d", 'Ð': "D", 'þ': "th", 'Þ': "TH", 'ı': "i", 'ħ': "h",
+	'Ħ': "H", 'ŧ': "t", 'Ŧ': "T", 'ŋ': "ng", 'Ŋ': "NG",
+}
+
+// latinSpelling transliterates Greek and Cyrillic letters. Accented
+// letters reach it decomposed, so only base letters are listed; capitals
+// are derived from the small letters in init.
+var latinSpelling = map[rune]string{
+	// Greek, after ELOT 743
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i",
+	'θ': "th", 'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x",
+	'ο': "o", 'π': "p", 'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y",
+	'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+	// Cyrillic, after the BGN/PCGN romanization of Russian and Ukrainian
+	'а': "a", 'б': "b", 'в': "v", 'г': "g", 'ґ': "g", 'д': "d", 'е': "e",
+	'є': "ye", 'ж': "zh", 'з': "z", 'и': "i", 'і': "i", 'к': "k", 'л': "l",
+	'м': "m", 'н': "n", 'о': "o", 'п': "p", 'р': "r", 'с': "s", 'т': "t",
+	'у': "u", 'ф': "f", 'х': "kh", 'ц': "ts", 'ч': "ch", 'ш': "sh",
+	'щ': "shch", 'ъ': "", 'ы': "y", 'ь': "", 'э': "e", 'ю': "yu", 'я': "ya",
+}
+
+func init() {
+	capitals := map[rune]string{}
+	for r, latin := range latinSpelling {
+		if latin != "" {
+			first, size := utf8.DecodeRuneInString(latin)
+			latin = string(unicode.ToUpper(first)) + latin[size:]
+		}
+		capitals[unicode.ToUpper(r)] = latin
+	}
+	for upper, latin := range capitals {
+		if _, listed := latinSpelling[upper]; !listed {
+			latinSpelling[upper] = latin
+		}
+	}
+}
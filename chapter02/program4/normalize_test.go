@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestFoldingMatches(t *testing.T) {
+	keep := Folding{KeepDiacritics: true}
+	latin := Folding{Transliterate: true}
+	for _, test := range []struct {
+		folding Folding
+		last    string
+		query   Query
+		want    bool
+	}{
+		{Folding{}, "Zola", MustAttributes(M{KEY_LAST: "zola"}), true},
+		{Folding{}, "Émile", MustAttributes(M{KEY_LAST: "emile"}), true},
+		{keep, "Émile", MustAttributes(M{KEY_LAST: "emile"}), false},
+		{keep, "Émile", MustAttributes(M{KEY_LAST: "émile"}), true},
+		{keep, "Émile", MustWhere(KEY_LAST, OP_PREFIX, "em"), false},
+		{keep, "Émile", MustWhere(KEY_LAST, OP_GLOB, "É*"), true},
+		{keep, "Émile", Not{MustWhere(KEY_LAST, OP_EQ, "Emile")}, true},
+		{Folding{}, "Чехов", MustAttributes(M{KEY_LAST: "chekhov"}), false},
+		{latin, "Чехов", MustAttributes(M{KEY_LAST: "chekhov"}), true},
+		{latin, "Chekhov", MustWhere(KEY_LAST, OP_EQ, "Чехов"), true},
+		{latin, "Чехов", MustWhere(KEY_LAST, OP_PREFIX, "chek"), true},
+		{latin, "Чехов", MustWhere(KEY_LAST, OP_REGEX, "^chekh?ov$"), true},
+		{latin, "Чехов", MustWhere(KEY_LAST, OP_FUZZY, "chekov"), true},
+		{latin, "Чехов", Or{MustWhere(KEY_LAST, OP_CONTAINS, "hekh"), MustAttributes(M{KEY_TITLE: "x"})}, true},
+		{latin, "Толстой", MustWhere(KEY_LAST, OP_IN, "Chekhov", "Tolstoi"), true},
+	} {
+		name := fmt.Sprintf("%+v: %s matching %s", test.folding, test.last, test.query)
+		c := NewCatalogue(test.folding)
+		if _, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: "Stories", KEY_LAST: test.last, KEY_GENRE: SCIFI})); err != nil {
+			t.Fatal(err)
+		}
+		c.mu.RLock()
+		found, scanned := len(c.find(test.query)) == 1, len(c.scan(test.query)) == 1
+		c.mu.RUnlock()
+		if found != test.want {
+			t.Errorf("%s: Find = %v, want %v", name, found, test.want)
+		}
+		if scanned != test.want {
+			t.Errorf("%s: scan = %v, want %v", name, scanned, test.want)
+		}
+	}
+}
+
+func TestCollate(t *testing.T) {
+	for _, test := range []struct {
+		a, b string
+		want int
+	}{
+		{"apple", "Banana", -1},
+		{"Title 9", "title 10", -1},
+		{"Title 010", "Title 9", 1},
+		{"Emile", "Émile", -1},
+		{"Émile", "Emilf", -1},
+		{"emile", "Emile", -1},
+		{"Zola", "zola", 1},
+		{"Life of Pi", "Life of Pi", 0},
+		{"Life", "Life of Pi", -1},
+	} {
+		if got := Collate(test.a, test.b); got != test.want {
+			t.Errorf("Collate(%q, %q) = %d, want %d", test.a, test.b, got, test.want)
+		}
+		if got := Collate(test.b, test.a); got != -test.want {
+			t.Errorf("Collate(%q, %q) = %d, want %d", test.b, test.a, got, -test.want)
+		}
+	}
+}
+
+func TestLocaleCollate(t *testing.T) {
+	for _, test := range []struct {
+		tag, a, b string
+		want      int
+	}{
+		{"en", "Öberg", "Zander", -1},
+		{"sv", "Öberg", "Zander", 1},
+		{"de", "Müller", "Mueller", 1},
+		{"de-u-co-phonebk", "Müller", "Muffler", -1},
+		{"en", "Book 9", "Book 10", -1},
+	} {
+		cmp, err := LocaleCollate(test.tag)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := cmp(test.a, test.b); got != test.want {
+			t.Errorf("%s: compare(%q, %q) = %d, want %d", test.tag, test.a, test.b, got, test.want)
+		}
+	}
+	if _, err := LocaleCollate("??"); err == nil {
+		t.Error(`LocaleCollate("??") succeeded`)
+	}
+}
+
+func TestFindPageLocale(t *testing.T) {
+	c := &Catalogue{}
+	for _, last := range []string{"Zander", "Öberg", "Andersson"} {
+		if _, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: "x", KEY_LAST: last, KEY_GENRE: SCIFI})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for locale, want := range map[string]string{"": "Andersson,Öberg,Zander", "sv": "Andersson,Zander,Öberg"} {
+		page, err := c.FindPage(And{}, FindOptions{Sort: []SortKey{{Key: KEY_LAST}}, Locale: locale})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, book := range page.Books {
+			names = append(names, book.Attrs.attrMap[KEY_LAST].([]interface{})[0].(string))
+		}
+		if got := strings.Join(names, ","); got != want {
+			t.Errorf("locale %q: sorted %s, want %s", locale, got, want)
+		}
+	}
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nsAtom   = "http://www.w3.org/2005/Atom"
+	nsDC     = "http://purl.org/dc/elements/1.1/"
+	nsDCTerm = "http://purl.org/dc/terms/"
+	nsOAIDC  = "http://www.openarchives.org/OAI/2.0/oai_dc/"
+	nsOPDS   = "http://opds-spec.org/2010/catalog"
+	nsThread = "http://purl.org/syndication/thread/1.0"
+
+	opdsNavigation  = "application/atom+xml;profile=opds-catalog;kind=navigation"
+	opdsAcquisition = "application/atom+xml;profile=opds-catalog;kind=acquisition"
+	opdsAcquire     = "http://opds-spec.org/acquisition"
+	openSearchType  = "application/opensearchdescription+xml"
+)
+
+// dcRecord is a book as an OAI Dublin Core record. Enum values are
+// subjects, except regions, which are the coverage.
+type dcRecord struct {
+	XMLName     xml.Name `xml:"oai_dc:dc"`
+	Identifiers []string `xml:"dc:identifier"` // the book's URN, then its ISBN
+	Title       string   `xml:"dc:title,omitempty"`
+	Creators    []string `xml:"dc:creator"`
+	Date        string   `xml:"dc:date,omitempty"`
+	Type        string   `xml:"dc:type"`
+	Subjects    []string `xml:"dc:subject"`
+	Coverage    []string `xml:"dc:coverage"`
+}
+
+type dcCollection struct {
+	XMLName xml.Name `xml:"collection"`
+	NSOAIDC string   `xml:"xmlns:oai_dc,attr"`
+	NSDC    string   `xml:"xmlns:dc,attr"`
+	Records []dcRecord
+}
+
+func bookURN(id int) string { return fmt.Sprintf("urn:catalogue:book:%d", id) }
+
+func newDCRecord(book *Book) dcRecord {
+	rec := dcRecord{Identifiers: []string{bookURN(book.ID)}, Type: "Text", Creators: authorNames(book.Attrs)}
+	if isbn, ok := book.Attrs.attrMap[KEY_ISBN].(ISBN); ok {
+		rec.Identifiers = append(rec.Identifiers, "urn:isbn:"+isbn.String())
+	}
+	rec.Title, _ = book.Attrs.attrMap[KEY_TITLE].(string)
+	if year, ok := book.Attrs.attrMap[KEY_YEAR].(int); ok {
+		rec.Date = strconv.Itoa(year)
+	}
+	for _, k := range book.Attrs.sortedKeys() {
+		if spec, _ := DefaultSchema.Spec(k); spec.Type != TYPE_ENUM {
+			continue
+		}
+		for _, v := range book.Attrs.values(k) {
+			if k == KEY_REGION {
+				rec.Coverage = append(rec.Coverage, DefaultSchema.Format(k, v))
+			} else {
+				rec.Subjects = append(rec.Subjects, DefaultSchema.Format(k, v))
+			}
+		}
+	}
+	return rec
+}
+
+// ExportDublinCore writes the books q matches, or every book for a nil q,
+// as Dublin Core XML.
+func (c *Catalogue) ExportDublinCore(w io.Writer, q Query) error {
+	books := c.Books()
+	if q != nil {
+		books = c.Find(q)
+	}
+	return WriteDublinCore(w, books)
+}
+
+// WriteDublinCore writes books as a collection of oai_dc records.
+func WriteDublinCore(w io.Writer, books []*Book) error {
+	coll := dcCollection{NSOAIDC: nsOAIDC, NSDC: nsDC, Records: []dcRecord{}}
+	for _, book := range books {
+		coll.Records = append(coll.Records, newDCRecord(book))
+	}
+	return writeXML(w, coll)
+}
+
+func writeXML(w io.Writer, v interface{}) error {
+	data, err := xml.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s%s\n", xml.Header, data)
+	return err
+}
+
+// AtomFeed is an Atom feed as OPDS uses it for catalogs.
+type AtomFeed struct {
+	XMLName   xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	NSDCTerms string      `xml:"xmlns:dcterms,attr"`
+	NSOPDS    string      `xml:"xmlns:opds,attr"`
+	NSThread  string      `xml:"xmlns:thr,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Author    AtomPerson  `xml:"author"`
+	Links     []AtomLink  `xml:"link"`
+	Entries   []AtomEntry `xml:"entry"`
+}
+
+type AtomEntry struct {
+	Title       string         `xml:"title"`
+	ID          string         `xml:"id"`
+	Updated     string         `xml:"updated"`
+	Authors     []AtomPerson   `xml:"author"`
+	Identifiers []string       `xml:"dcterms:identifier"`
+	Issued      string         `xml:"dcterms:issued,omitempty"`
+	Categories  []AtomCategory `xml:"category"`
+	Content     *AtomContent   `xml:"content,omitempty"`
+	Links       []AtomLink     `xml:"link"`
+}
+
+type AtomPerson struct {
+	Name string `xml:"name"`
+}
+
+type AtomLink struct {
+	Rel   string `xml:"rel,attr"`
+	Href  string `xml:"href,attr"`
+	Type  string `xml:"type,attr,omitempty"`
+	Title string `xml:"title,attr,omitempty"`
+	Count int    `xml:"thr:count,attr,omitempty"` // books behind a navigation link
+}
+
+type AtomCategory struct {
+	Scheme string `xml:"scheme,attr"`
+	Term   string `xml:"term,attr"`
+	Label  string `xml:"label,attr"`
+}
+
+type AtomContent struct {
+	Type string `xml:"type,attr"`
+	Text string `xml:",chardata"`
+}
+
+// OPDS publishes a catalogue as an OPDS 1.2 catalog under the URL path
+// Base:
+//
+//	Base                  the start feed, navigating to the facets
+//	Base/all              every book
+//	Base/{key}            a navigation feed of the values of a facet key,
+//	                      with their counts
+//	Base/{key}/{value}    the books with that value
+//	Base/search?q=        books ranked by the title words of a search
+//	Base/search.xml       the OpenSearch description of the search
+//	Base/books/{id}       a book's Dublin Core record
+//
+// Acquisition feeds are sorted by title and paged with a next link. The
+// catalogue holds no book files, so each book's acquisition link points
+// at its Dublin Core record.
+type OPDS struct {
+	c        *Catalogue
+	Base     string
+	Title    string
+	Facets   []Key     // the keys the start feed navigates by
+	PageSize int       // books per acquisition feed page
+	Updated  time.Time // the update time of every feed; zero means now
+}
+
+func NewOPDS(c *Catalogue, base string) *OPDS {
+	return &OPDS{
+		c:        c,
+		Base:     strings.TrimSuffix(base, "/"),
+		Title:    "Catalogue",
+		Facets:   []Key{KEY_KIND, KEY_GENRE, KEY_REGION},
+		PageSize: defaultPageSize,
+	}
+}
+
+func bookCount(n int) string {
+	if n == 1 {
+		return "1 book"
+	}
+	return fmt.Sprintf("%d books", n)
+}
+
+func (o *OPDS) updated() string {
+	t := o.Updated
+	if t.IsZero() {
+		t = time.Now()
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func (o *OPDS) feed(id, title, self, kind string) *AtomFeed {
+	return &AtomFeed{
+		NSDCTerms: nsDCTerm,
+		NSOPDS:    nsOPDS,
+		NSThread:  nsThread,
+		ID:        "urn:catalogue:" + id,
+		Title:     title,
+		Updated:   o.updated(),
+		Author:    AtomPerson{Name: o.Title},
+		Links: []AtomLink{
+			{Rel: "self", Href: self, Type: kind},
+			{Rel: "start", Href: o.Base, Type: opdsNavigation},
+			{Rel: "search", Href: o.Base + "/search.xml", Type: openSearchType},
+		},
+	}
+}
+
+// Start returns the start feed, which links to every book and to a
+// navigation feed for each facet key.
+func (o *OPDS) Start() *AtomFeed {
+	f := o.feed("root", o.Title, o.Base, opdsNavigation)
+	f.Entries = append(f.Entries, AtomEntry{
+		Title:   "All books",
+		ID:      "urn:catalogue:all",
+		Updated: f.Updated,
+		Content: &AtomContent{Type: "text", Text: bookCount(o.c.Len())},
+		Links:   []AtomLink{{Rel: "subsection", Href: o.Base + "/all", Type: opdsAcquisition}},
+	})
+	for _, k := range o.Facets {
+		name := strings.ToLower(k.String())
+		f.Entries = append(f.Entries, AtomEntry{
+			Title:   "By " + name,
+			ID:      "urn:catalogue:" + name,
+			Updated: f.Updated,
+			Content: &AtomContent{Type: "text", Text: "Books by " + name},
+			Links:   []AtomLink{{Rel: "subsection", Href: o.Base + "/" + name, Type: opdsNavigation}},
+		})
+	}
+	return f
+}
+
+// Navigation returns a feed with an entry for each value of k that books
+// carry, most common first.
+func (o *OPDS) Navigation(k Key) (*AtomFeed, error) {
+	facets, err := o.c.Facets(nil, k)
+	if err != nil {
+		return nil, err
+	}
+	name := strings.ToLower(k.String())
+	f := o.feed(name, "Books by "+name, o.Base+"/"+name, opdsNavigation)
+	for _, fc := range facets[0].Counts {
+		f.Entries = append(f.Entries, AtomEntry{
+			Title:   fc.Label,
+			ID:      "urn:catalogue:" + name + ":" + url.PathEscape(fc.Label),
+			Updated: f.Updated,
+			Content: &AtomContent{Type: "text", Text: bookCount(fc.Count)},
+			Links: []AtomLink{{
+				Rel:   "subsection",
+				Href:  o.Base + "/" + name + "/" + url.PathEscape(fc.Label),
+				Type:  opdsAcquisition,
+				Count: fc.Count,
+			}},
+		})
+	}
+	return f, nil
+}
+
+// Acquisition returns a page of the books q matches, sorted by title,
+// starting after cursor. The feed links to the next page.
+func (o *OPDS) Acquisition(q Query, id, title, self, cursor string) (*AtomFeed, error) {
+	page, err := o.c.FindPage(q, FindOptions{Sort: []SortKey{{Key: KEY_TITLE}}, Limit: o.PageSize, Cursor: cursor})
+	if err != nil {
+		return nil, err
+	}
+	f := o.feed(id, title, self, opdsAcquisition)
+	if page.Next != "" {
+		sep := "?"
+		if strings.Contains(self, "?") {
+			sep = "&"
+		}
+		f.Links = append(f.Links, AtomLink{Rel: "next", Href: self + sep + "cursor=" + url.QueryEscape(page.Next), Type: opdsAcquisition})
+	}
+	for _, book := range page.Books {
+		f.Entries = append(f.Entries, o.entry(book, f.Updated))
+	}
+	return f, nil
+}
+
+// ValueFeed returns a page of the books whose k is v, as Navigation
+// links to them.
+func (o *OPDS) ValueFeed(k Key, v interface{}, cursor string) (*AtomFeed, error) {
+	q, err := Where(k, OP_EQ, v)
+	if err != nil {
+		return nil, err
+	}
+	label := DefaultSchema.Format(k, v)
+	name := strings.ToLower(k.String())
+	return o.Acquisition(q, name+":"+url.PathEscape(label), fmt.Sprintf("Books by %s: %s", name, label),
+		o.Base+"/"+name+"/"+url.PathEscape(label), cursor)
+}
+
+// SearchFeed returns the books whose titles best match text, best first.
+func (o *OPDS) SearchFeed(text string) *AtomFeed {
+	self := o.Base + "/search?q=" + url.QueryEscape(text)
+	f := o.feed("search:"+url.QueryEscape(text), fmt.Sprintf("Search for %q", text), self, opdsAcquisition)
+	for _, hit := range o.c.Search(text, nil, o.PageSize) {
+		f.Entries = append(f.Entries, o.entry(hit.Book, f.Updated))
+	}
+	return f
+}
+
+func (o *OPDS) entry(book *Book, updated string) AtomEntry {
+	rec := newDCRecord(book)
+	e := AtomEntry{Title: rec.Title, ID: rec.Identifiers[0], Updated: updated, Identifiers: rec.Identifiers[1:], Issued: rec.Date}
+	for _, name := range rec.Creators {
+		if last, first, ok := strings.Cut(name, ", "); ok {
+			name = first + " " + last
+		}
+		e.Authors = append(e.Authors, AtomPerson{Name: name})
+	}
+	for _, k := range book.Attrs.sortedKeys() {
+		if spec, _ := DefaultSchema.Spec(k); spec.Type != TYPE_ENUM {
+			continue
+		}
+		for _, v := range book.Attrs.values(k) {
+			label := DefaultSchema.Format(k, v)
+			e.Categories = append(e.Categories, AtomCategory{
+				Scheme: "urn:catalogue:" + strings.ToLower(k.String()),
+				Term:   label,
+				Label:  label,
+			})
+		}
+	}
+	e.Links = []AtomLink{{Rel: opdsAcquire, Href: fmt.Sprintf("%s/books/%d", o.Base, book.ID), Type: "application/xml"}}
+	return e
+}
+
+// openSearchDescription tells readers how to search the catalog.
+type openSearchDescription struct {
+	XMLName     xml.Name `xml:"http://a9.com/-/spec/opensearch/1.1/ OpenSearchDescription"`
+	ShortName   string   `xml:"ShortName"`
+	Description string   `xml:"Description"`
+	URL         struct {
+		Type     string `xml:"type,attr"`
+		Template string `xml:"template,attr"`
+	} `xml:"Url"`
+}
+
+// ServeHTTP answers the requests under o.Base.
+func (o *OPDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rest, ok := strings.CutPrefix(r.URL.Path, o.Base)
+	if !ok || r.Method != http.MethodGet {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	cursor := r.URL.Query().Get("cursor")
+	var feed *AtomFeed
+	var err error
+	switch {
+	case rest == "" || rest == "/":
+		feed = o.Start()
+	case parts[0] == "all" && len(parts) == 1:
+		feed, err = o.Acquisition(And{}, "all", "All books", o.Base+"/all", cursor)
+	case parts[0] == "search" && len(parts) == 1:
+		feed = o.SearchFeed(r.URL.Query().Get("q"))
+	case parts[0] == "search.xml" && len(parts) == 1:
+		var desc openSearchDescription
+		desc.ShortName, desc.Description = o.Title, "Search the titles of "+o.Title
+		desc.URL.Type = opdsAcquisition
+		desc.URL.Template = o.Base + "/search?q={searchTerms}"
+		w.Header().Set("Content-Type", openSearchType)
+		writeXML(w, desc)
+		return
+	case parts[0] == "books" && len(parts) == 2:
+		id, err := bookID(parts[1])
+		book, ok := o.c.Get(id)
+		if err != nil || !ok {
+			http.NotFound(w, r)
+			return
+		}
+		rec := newDCRecord(book)
+		w.Header().Set("Content-Type", "application/xml")
+		writeXML(w, struct {
+			dcRecord
+			NSOAIDC string `xml:"xmlns:oai_dc,attr"`
+			NSDC    string `xml:"xmlns:dc,attr"`
+		}{rec, nsOAIDC, nsDC})
+		return
+	default:
+		k, known := DefaultSchema.Lookup(parts[0])
+		spec, _ := DefaultSchema.Spec(k)
+		if !known || spec.Type != TYPE_ENUM || len(parts) > 2 {
+			http.NotFound(w, r)
+			return
+		}
+		if len(parts) == 1 {
+			feed, err = o.Navigation(k)
+			break
+		}
+		v, perr := DefaultSchema.Parse(k, parts[1])
+		if perr != nil {
+			http.NotFound(w, r)
+			return
+		}
+		feed, err = o.ValueFeed(k, v, cursor)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	kind := opdsNavigation
+	for _, l := range feed.Links {
+		if l.Rel == "self" {
+			kind = l.Type
+		}
+	}
+	w.Header().Set("Content-Type", kind)
+	writeXML(w, feed)
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// Query selects books by their attributes. *Attributes is itself a Query
+// matching the books that carry every one of its pairs; keys it leaves out
+// match anything.
+type Query interface {
+	Matches(book *Attributes) bool
+	String() string
+}
+
+// foldedQuery is implemented by queries that compare strings, whose
+// Matches folds them by the zero Folding. matchesUnder folds them by f, as
+// the catalogue the query runs against does.
+type foldedQuery interface {
+	matchesUnder(book *Attributes, f Folding) bool
+}
+
+// matchesUnder reports whether q matches book when strings are compared as
+// f folds them.
+func matchesUnder(q Query, book *Attributes, f Folding) bool {
+	if fq, ok := q.(foldedQuery); ok {
+		return fq.matchesUnder(book, f)
+	}
+	return q.Matches(book)
+}
+
+// indexedQuery is implemented by queries the Index can answer without
+// looking at the books. postings reports false if it cannot.
+type indexedQuery interface {
+	postings(ix *Index) ([]int, bool)
+}
+
+func (a *Attributes) Matches(book *Attributes) bool { return book.IsMatch(a) }
+
+func (a *Attributes) matchesUnder(book *Attributes, f Folding) bool { return book.isMatch(a, f) }
+
+// postings intersects the lists of every value, starting with the shortest.
+func (a *Attributes) postings(ix *Index) ([]int, bool) {
+	lists := make([][]int, 0, len(a.attrMap))
+	for k := range a.attrMap {
+		for _, v := range a.values(k) {
+			list := ix.lookup(k, v)
+			if len(list) == 0 {
+				return nil, true
+			}
+			lists = append(lists, list)
+		}
+	}
+	return intersectAll(lists, ix), true
+}
+
+func intersectAll(lists [][]int, ix *Index) []int {
+	if len(lists) == 0 {
+		return ix.all()
+	}
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	ids := lists[0]
+	for _, list := range lists[1:] {
+		if ids = intersect(ids, list); len(ids) == 0 {
+			return nil
+		}
+	}
+	return ids
+}
+
+type Op int
+
+const (
+	OP_EQ Op = iota
+	OP_LT
+	OP_LE
+	OP_GT
+	OP_GE
+	OP_BETWEEN
+	OP_IN
+	OP_PREFIX   // string starts with the value
+	OP_CONTAINS // string contains the value
+	OP_GLOB     // whole string matches a pattern with * ? and [...]
+	OP_REGEX    // string contains a match of a regular expression
+	OP_FUZZY    // string is within a few edits of the value
+)
+
+var opNames = [...]string{"=", "<", "<=", ">", ">=", "between", "in", "prefix", "contains", "glob", "regex", "fuzzy"}
+
+func (op Op) String() string { return opNames[op] }
+
+// Predicate compares the value of one key. Int keys compare numerically
+// and enum keys by their position in the vocabulary. String keys ignore
+// case in every mode, and compare whole runes. A book without the key
+// never matches; one with several values matches if any of them does.
+// Build predicates with Where, which prepares the patterns.
+type Predicate struct {
+	Key     Key
+	Op      Op
+	Values  []interface{}
+	folding Folding        // the folding fold and re were made with
+	fold    string         // case-folded operand of OP_PREFIX, OP_CONTAINS and OP_FUZZY
+	re      *regexp.Regexp // compiled operand of OP_GLOB and OP_REGEX
+	dist    int            // edits OP_FUZZY allows
+
+	bound atomic.Pointer[Predicate] // a copy made for the last other folding
+}
+
+// Where builds a Predicate, checking the operand count and that every
+// operand has the type k holds. Ordering operators need an int or enum
+// key; the prefix, contains, glob, regex and fuzzy modes need a string key.
+func Where(k Key, op Op, values ...interface{}) (*Predicate, error) {
+	spec, ok := DefaultSchema.Spec(k)
+	if !ok {
+		return nil, fmt.Errorf("unknown key %s", k)
+	}
+	if op < OP_EQ || op > OP_FUZZY {
+		return nil, fmt.Errorf("invalid operator %d", int(op))
+	}
+	want := 1
+	switch op {
+	case OP_BETWEEN:
+		want = 2
+	case OP_IN:
+		want = len(values)
+	}
+	if len(values) != want || len(values) == 0 {
+		return nil, fmt.Errorf("%s %s: wrong number of values (%d)", k, op, len(values))
+	}
+	if (spec.Type == TYPE_STRING || spec.Type == TYPE_ISBN) && op >= OP_LT && op <= OP_BETWEEN {
+		return nil, fmt.Errorf("%s %s: %s keys do not support ordering", k, op, spec.Type)
+	}
+	if spec.Type != TYPE_STRING && op >= OP_PREFIX {
+		return nil, fmt.Errorf("%s %s: only string keys support %s", k, op, op)
+	}
+	var errs AttrErrors
+	for _, v := range values {
+		if err := DefaultSchema.Check(k, v); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+	p := &Predicate{Key: k, Op: op, Values: values}
+	if op == OP_FUZZY {
+		p.dist = autoFuzziness(values[0].(string))
+	}
+	if err := p.compile(Folding{}); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// compile folds the string operand by f, so it can be tested against
+// terms folded the same way.
+func (p *Predicate) compile(f Folding) error {
+	p.folding = f
+	switch p.Op {
+	case OP_PREFIX, OP_CONTAINS, OP_FUZZY:
+		p.fold = f.key(p.Values[0].(string))
+	case OP_GLOB:
+		re, err := regexp.Compile(globToRegexp(f.Fold(p.Values[0].(string))))
+		if err != nil {
+			return fmt.Errorf("%s glob: %v", p.Key, err)
+		}
+		p.re = re
+	case OP_REGEX:
+		re, err := regexp.Compile("(?i)" + f.Fold(p.Values[0].(string)))
+		if err != nil {
+			return fmt.Errorf("%s regex: %v", p.Key, err)
+		}
+		p.re = re
+	}
+	return nil
+}
+
+// globToRegexp translates a glob, in which * matches any run of
+// characters, ? any one character and [...] a class ([!...] negated), into
+// an anchored case-insensitive regular expression. A backslash escapes the
+// character after it; an unclosed [ is taken literally.
+func globToRegexp(glob string) string {
+	var sb strings.Builder
+	sb.WriteString("(?is)^")
+	for i := 0; i < len(glob); {
+		r, size := utf8.DecodeRuneInString(glob[i:])
+		i += size
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		case '\\':
+			if i < len(glob) {
+				r, size = utf8.DecodeRuneInString(glob[i:])
+				i += size
+			}
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		case '[':
+			j := i
+			if j < len(glob) && glob[j] == '!' {
+				j++
+			}
+			if j < len(glob) && glob[j] == ']' { // a leading ] is part of the class
+				j++
+			}
+			end := strings.IndexByte(glob[j:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				continue
+			}
+			class := glob[i : j+end]
+			i = j + end + 1
+			sb.WriteByte('[')
+			if strings.HasPrefix(class, "!") {
+				sb.WriteByte('^')
+				class = class[1:]
+			}
+			for _, c := range class {
+				if c == '\\' || c == '[' || c == ']' || c == '^' {
+					sb.WriteByte('\\')
+				}
+				sb.WriteRune(c)
+			}
+			sb.WriteByte(']')
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString("$")
+	return sb.String()
+}
+
+// MustWhere is like Where but panics on an invalid predicate.
+func MustWhere(k Key, op Op, values ...interface{}) *Predicate {
+	p, err := Where(k, op, values...)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
+
+func (p *Predicate) Matches(book *Attributes) bool { return p.matchesUnder(book, Folding{}) }
+
+func (p *Predicate) matchesUnder(book *Attributes, f Folding) bool {
+	p = p.under(f)
+	for _, v := range book.values(p.Key) {
+		if p.test(f.term(v)) {
+			return true
+		}
+	}
+	return false
+}
+
+// under returns p with its operand folded by f. Where folds it by the zero
+// Folding; a copy for another folding is made once and kept.
+func (p *Predicate) under(f Folding) *Predicate {
+	if f == p.folding {
+		return p
+	}
+	if b := p.bound.Load(); b != nil && b.folding == f {
+		return b
+	}
+	b := &Predicate{Key: p.Key, Op: p.Op, Values: p.Values, dist: p.dist}
+	if err := b.compile(f); err != nil {
+		return p // a pattern that is only invalid once folded
+	}
+	p.bound.Store(b)
+	return b
+}
+
+// test applies the predicate to an index term.
+func (p *Predicate) test(term interface{}) bool {
+	switch p.Op {
+	case OP_PREFIX:
+		return strings.HasPrefix(term.(string), p.fold)
+	case OP_CONTAINS:
+		return strings.Contains(term.(string), p.fold)
+	case OP_GLOB, OP_REGEX:
+		return p.re.MatchString(term.(string))
+	case OP_FUZZY:
+		return editDistance(p.fold, term.(string), p.dist) <= p.dist
+	case OP_EQ, OP_IN:
+		for _, v := range p.Values {
+			if p.folding.term(v) == term {
+				return true
+			}
+		}
+		return false
+	case OP_BETWEEN:
+		return ordinal(p.Values[0]) <= ordinal(term) && ordinal(term) <= ordinal(p.Values[1])
+	}
+	x, y := ordinal(term), ordinal(p.Values[0])
+	switch p.Op {
+	case OP_LT:
+		return x < y
+	case OP_LE:
+		return x <= y
+	case OP_GT:
+		return x > y
+	default:
+		return x >= y
+	}
+}
+
+// postings unions the lists of every distinct value that passes the test.
+// Equality looks its values up instead of testing every term.
+func (p *Predicate) postings(ix *Index) ([]int, bool) {
+	p = p.under(ix.folding)
+	var lists [][]int
+	if p.Op == OP_EQ || p.Op == OP_IN {
+		for _, v := range p.Values {
+			lists = append(lists, ix.lookup(p.Key, v))
+		}
+		return union(lists), true
+	}
+	for term, list := range ix.postings[p.Key] {
+		if p.test(term) {
+			lists = append(lists, list)
+		}
+	}
+	return union(lists), true
+}
+
+func (p *Predicate) String() string {
+	vals := make([]string, len(p.Values))
+	for i, v := range p.Values {
+		vals[i] = DefaultSchema.Format(p.Key, v)
+		if p.Op == OP_REGEX {
+			vals[i] = "/" + vals[i] + "/"
+		} else if _, ok := v.(string); ok {
+			vals[i] = "'" + vals[i] + "'"
+		}
+	}
+	switch p.Op {
+	case OP_BETWEEN:
+		return fmt.Sprintf("%s between %s and %s", p.Key, vals[0], vals[1])
+	case OP_IN:
+		return fmt.Sprintf("%s in (%s)", p.Key, strings.Join(vals, ", "))
+	case OP_FUZZY:
+		return fmt.Sprintf("%s fuzzy %s within %d", p.Key, vals[0], p.dist)
+	}
+	return fmt.Sprintf("%s %s %s", p.Key, p.Op, vals[0])
+}
+
+// ordinal orders int values and enum values by vocabulary position.
+func ordinal(v interface{}) int64 {
+	if rv := reflect.ValueOf(v); rv.CanInt() {
+		return rv.Int()
+	}
+	return 0
+}
+
+// And matches the books that every one of its queries matches. An
+// *Attributes target is shorthand for an And of equalities.
+type And []Query
+
+func (and And) Matches(book *Attributes) bool { return and.matchesUnder(book, Folding{}) }
+
+func (and And) matchesUnder(book *Attributes, f Folding) bool {
+	for _, q := range and {
+		if !matchesUnder(q, book, f) {
+			return false
+		}
+	}
+	return true
+}
+
+func (and And) postings(ix *Index) ([]int, bool) {
+	lists, ok := childPostings(and, ix)
+	if !ok {
+		return nil, false
+	}
+	for _, list := range lists {
+		if len(list) == 0 {
+			return nil, true
+		}
+	}
+	return intersectAll(lists, ix), true
+}
+
+func (and And) String() string { return joinQueries(and, " and ") }
+
+// Or matches the books that any of its queries matches.
+type Or []Query
+
+func (or Or) Matches(book *Attributes) bool { return or.matchesUnder(book, Folding{}) }
+
+func (or Or) matchesUnder(book *Attributes, f Folding) bool {
+	for _, q := range or {
+		if matchesUnder(q, book, f) {
+			return true
+		}
+	}
+	return false
+}
+
+func (or Or) postings(ix *Index) ([]int, bool) {
+	lists, ok := childPostings(or, ix)
+	if !ok {
+		return nil, false
+	}
+	return union(lists), true
+}
+
+func (or Or) String() string { return joinQueries(or, " or ") }
+
+// Not matches the books its query does not.
+type Not struct {
+	Query Query
+}
+
+func (not Not) Matches(book *Attributes) bool { return !not.Query.Matches(book) }
+
+func (not Not) matchesUnder(book *Attributes, f Folding) bool {
+	return !matchesUnder(not.Query, book, f)
+}
+
+func (not Not) postings(ix *Index) ([]int, bool) {
+	lists, ok := childPostings([]Query{not.Query}, ix)
+	if !ok {
+		return nil, false
+	}
+	var out []int
+	excluded := lists[0]
+	for _, id := range ix.all() {
+		if len(excluded) > 0 && excluded[0] == id {
+			excluded = excluded[1:]
+			continue
+		}
+		out = append(out, id)
+	}
+	return out, true
+}
+
+func (not Not) String() string { return "not " + groupQuery(not.Query) }
+
+func childPostings(queries []Query, ix *Index) ([][]int, bool) {
+	lists := make([][]int, len(queries))
+	for i, q := range queries {
+		iq, ok := q.(indexedQuery)
+		if !ok {
+			return nil, false
+		}
+		if lists[i], ok = iq.postings(ix); !ok {
+			return nil, false
+		}
+	}
+	return lists, true
+}
+
+func joinQueries(queries []Query, sep string) string {
+	parts := make([]string, len(queries))
+	for i, q := range queries {
+		parts[i] = groupQuery(q)
+	}
+	return strings.Join(parts, sep)
+}
+
+// groupQuery parenthesizes And and Or so nested queries print unambiguously.
+func groupQuery(q Query) string {
+	switch q.(type) {
+	case And, Or:
+		return "(" + q.String() + ")"
+	}
+	return q.String()
+}
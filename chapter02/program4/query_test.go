@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuery(t *testing.T) {
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"", ""},
+		{"year>=-500", "YEAR >= -500"},
+		{"year:-500..-100", "YEAR between -500 and -100"},
+		{"-year:1900", "not YEAR = 1900"},
+		{"last:-king", "LAST = '-king'"},
+		{"kind:fiction -genre:horror", "KIND = fiction and not GENRE = horror"},
+		{"kind:fiction -(genre:horror OR genre:scifi)", "KIND = fiction and not (GENRE = horror or GENRE = scifi)"},
+		{"last:king OR last:christie genre:horror", "LAST = 'king' or (LAST = 'christie' and GENRE = horror)"},
+		{"last:king OR last:christie AND genre:horror", "LAST = 'king' or (LAST = 'christie' and GENRE = horror)"},
+		{"NOT last:king OR title:x", "not LAST = 'king' or TITLE = 'x'"},
+		{"(last:king OR last:christie) AND NOT genre:horror", "(LAST = 'king' or LAST = 'christie') and not GENRE = horror"},
+		{"Region:CHINA,india", "REGION in (China, India)"},
+		{"year:1900..1970", "YEAR between 1900 and 1970"},
+		{"title:life*", "TITLE prefix 'life'"},
+		{`title:"life*"`, "TITLE = 'life*'"},
+		{"title~pi", "TITLE contains 'pi'"},
+		{"last:shelly~1", "LAST fuzzy 'shelly' within 1"},
+		{"title:/of (pi|mice)/", "TITLE regex /of (pi|mice)/"},
+	} {
+		q, err := ParseQuery(test.input)
+		if err != nil {
+			t.Errorf("ParseQuery(%q): %v", test.input, err)
+			continue
+		}
+		if got := q.String(); got != test.want {
+			t.Errorf("ParseQuery(%q) = %s, want %s", test.input, got, test.want)
+		}
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, test := range []struct {
+		input string
+		col   int
+	}{
+		{"year>>1", 6},
+		{"colour:red", 1},
+		{"year:soon", 6},
+		{"(last:king", 11},
+		{"last:king)", 10},
+		{`title:"life`, 7},
+		{"title:/of", 7},
+		{"AND last:king", 1},
+		{"year>=", 7},
+	} {
+		_, err := ParseQuery(test.input)
+		var se *SyntaxError
+		if !errors.As(err, &se) {
+			t.Errorf("ParseQuery(%q): error %v, want a SyntaxError", test.input, err)
+			continue
+		}
+		if col := len([]rune(se.Input[:se.Pos])) + 1; col != test.col {
+			t.Errorf("ParseQuery(%q): %v, want column %d", test.input, err, test.col)
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ParseQuery reads a query typed as text, for example
+//
+//	kind:fiction genre:horror last:king year>=1980
+//	(last:king OR last:christie) AND NOT genre:horror
+//	title:"Life of Pi" year:1900..1970 region:china,india
+//
+// A term is a field, an operator (: = < <= > >=) and a value; field and
+// enum names are matched ignoring case. A value list a,b matches any of
+// its values and a..b is an inclusive range. String fields also take
+//
+//	title:life*            a glob; a lone trailing * matches a prefix
+//	title~pi               a substring
+//	title:/of (pi|mice)/   a regular expression
+//	last:shelly~           within a few edits, or last:shelly~1 for one
+//
+// Quoted values are always matched whole. Adjacent terms are ANDed; AND,
+// OR, NOT (or a - before a term) and parentheses combine them. An empty query
+// matches every book.
+func ParseQuery(input string) (Query, error) {
+	toks, err := lexQuery(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{input: input, toks: toks}
+	if p.peek().kind == tokEOF {
+		return And{}, nil
+	}
+	q, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %q", t.text)
+	}
+	return q, nil
+}
+
+// SyntaxError reports where in the input a query went wrong.
+type SyntaxError struct {
+	Input string
+	Pos   int // byte offset into Input
+	Msg   string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("column %d: %s", utf8.RuneCountInString(e.Input[:e.Pos])+1, e.Msg)
+}
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokOp
+	tokLParen
+	tokRParen
+	tokComma
+	tokRange
+	tokNot
+	tokRegex
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lexQuery(input string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(input); {
+		r, size := utf8.DecodeRuneInString(input[i:])
+		start := i
+		switch {
+		case unicode.IsSpace(r):
+			i += size
+			continue
+		case r == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case r == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case r == ',':
+			toks = append(toks, token{tokComma, ",", i})
+			i++
+		case strings.HasPrefix(input[i:], ".."):
+			toks = append(toks, token{tokRange, "..", i})
+			i += 2
+		case r == '<' || r == '>':
+			i++
+			if i < len(input) && input[i] == '=' {
+				i++
+			}
+			toks = append(toks, token{tokOp, input[start:i], start})
+		case r == ':' || r == '=' || r == '~':
+			toks = append(toks, token{tokOp, input[i : i+1], i})
+			i++
+		case r == '-' && !inValue(toks):
+			toks = append(toks, token{tokNot, "-", i})
+			i++
+		case r == '"' || r == '\'':
+			var sb strings.Builder
+			for i++; i < len(input) && rune(input[i]) != r; i++ {
+				if input[i] == '\\' && i+1 < len(input) {
+					i++
+				}
+				sb.WriteByte(input[i])
+			}
+			if i >= len(input) {
+				return nil, &SyntaxError{Input: input, Pos: start, Msg: "unterminated string"}
+			}
+			i++
+			toks = append(toks, token{tokString, sb.String(), start})
+		case r == '/':
+			var sb strings.Builder
+			for i++; i < len(input) && input[i] != '/'; i++ {
+				if input[i] == '\\' && i+1 < len(input) && input[i+1] == '/' {
+					i++
+				}
+				sb.WriteByte(input[i])
+			}
+			if i >= len(input) {
+				return nil, &SyntaxError{Input: input, Pos: start, Msg: "unterminated regular expression"}
+			}
+			i++
+			toks = append(toks, token{tokRegex, sb.String(), start})
+		default:
+			for i < len(input) {
+				r, size := utf8.DecodeRuneInString(input[i:])
+				if unicode.IsSpace(r) || strings.ContainsRune("():=<>,~", r) || strings.HasPrefix(input[i:], "..") {
+					break
+				}
+				i += size
+			}
+			toks = append(toks, token{tokWord, input[start:i], start})
+		}
+	}
+	return append(toks, token{tokEOF, "end of query", len(input)}), nil
+}
+
+// inValue reports whether the next token is a value, so that a '-' there
+// is a sign, as in year>=-500, rather than negating a term.
+func inValue(toks []token) bool {
+	if len(toks) == 0 {
+		return false
+	}
+	switch toks[len(toks)-1].kind {
+	case tokOp, tokComma, tokRange:
+		return true
+	}
+	return false
+}
+
+type queryParser struct {
+	input string
+	toks  []token
+	pos   int
+}
+
+func (p *queryParser) peek() token { return p.toks[p.pos] }
+
+func (p *queryParser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the next token if it is the bare word kw.
+func (p *queryParser) keyword(kw string) bool {
+	if t := p.peek(); t.kind == tokWord && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorf(t token, format string, args ...interface{}) error {
+	return &SyntaxError{Input: p.input, Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *queryParser) parseOr() (Query, error) {
+	var or Or
+	for {
+		q, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+		if !p.keyword("OR") {
+			break
+		}
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) parseAnd() (Query, error) {
+	var and And
+	for {
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		and = append(and, q)
+		if p.keyword("AND") {
+			continue
+		}
+		t := p.peek()
+		if t.kind == tokEOF || t.kind == tokRParen || (t.kind == tokWord && strings.EqualFold(t.text, "OR")) {
+			break
+		}
+	}
+	if len(and) == 1 {
+		return and[0], nil
+	}
+	return and, nil
+}
+
+func (p *queryParser) parseUnary() (Query, error) {
+	if p.peek().kind == tokNot || p.keyword("NOT") {
+		if p.peek().kind == tokNot {
+			p.next()
+		}
+		q, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return Not{q}, nil
+	}
+	if p.peek().kind == tokLParen {
+		open := p.next()
+		q, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			col := utf8.RuneCountInString(p.input[:open.pos]) + 1
+			return nil, p.errorf(p.peek(), "missing ) for ( at column %d", col)
+		}
+		p.next()
+		return q, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *queryParser) parseTerm() (Query, error) {
+	field := p.next()
+	if field.kind != tokWord {
+		return nil, p.errorf(field, "expected a field name, found %q", field.text)
+	}
+	k, ok := DefaultSchema.Lookup(field.text)
+	if !ok {
+		return nil, p.errorf(field, "unknown field %q", field.text)
+	}
+	opTok := p.next()
+	if opTok.kind != tokOp {
+		return nil, p.errorf(opTok, "expected an operator after %s, found %q", k, opTok.text)
+	}
+	op := map[string]Op{":": OP_EQ, "=": OP_EQ, "<": OP_LT, "<=": OP_LE, ">": OP_GT, ">=": OP_GE, "~": OP_CONTAINS}[opTok.text]
+	if spec, _ := DefaultSchema.Spec(k); op == OP_CONTAINS && spec.Type != TYPE_STRING {
+		return nil, p.errorf(opTok, "~ needs a string field, not %s", k)
+	}
+	if t := p.peek(); t.kind == tokRegex {
+		p.next()
+		if op != OP_EQ {
+			return nil, p.errorf(opTok, "a regular expression needs : or =, not %s", opTok.text)
+		}
+		return p.where(field, k, OP_REGEX, t.text)
+	}
+
+	quoted := []bool{p.peek().kind == tokString}
+	first, err := p.parseValue(k)
+	if err != nil {
+		return nil, err
+	}
+	values := []interface{}{first}
+	switch p.peek().kind {
+	case tokRange:
+		p.next()
+		last, err := p.parseValue(k)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, last)
+		if op != OP_EQ {
+			return nil, p.errorf(opTok, "a range needs : or =, not %s", opTok.text)
+		}
+		op = OP_BETWEEN
+	case tokComma:
+		for p.peek().kind == tokComma {
+			p.next()
+			quoted = append(quoted, p.peek().kind == tokString)
+			v, err := p.parseValue(k)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+		}
+		if op != OP_EQ {
+			return nil, p.errorf(opTok, "a value list needs : or =, not %s", opTok.text)
+		}
+		op = OP_IN
+	}
+	if t := p.peek(); t.kind == tokOp && t.text == "~" {
+		p.next()
+		if op != OP_EQ {
+			return nil, p.errorf(t, "a fuzzy match needs a single value after : or =")
+		}
+		text, _ := first.(string)
+		if n := p.peek(); n.kind == tokWord {
+			if dist, err := strconv.Atoi(n.text); err == nil {
+				p.next()
+				pred, err := Fuzzy(k, text, dist)
+				if err != nil {
+					return nil, p.errorf(field, "%v", err)
+				}
+				return pred, nil
+			}
+		}
+		return p.where(field, k, OP_FUZZY, text)
+	}
+	if op == OP_EQ || op == OP_IN {
+		return p.patterns(field, k, op, values, quoted)
+	}
+	return p.where(field, k, op, values...)
+}
+
+// patterns turns the unquoted values holding glob characters into glob or
+// prefix predicates, ORed with an equality for the rest.
+func (p *queryParser) patterns(field token, k Key, op Op, values []interface{}, quoted []bool) (Query, error) {
+	var or Or
+	var plain []interface{}
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok || quoted[i] || !strings.ContainsAny(s, "*?[") {
+			plain = append(plain, v)
+			continue
+		}
+		mode := OP_GLOB
+		if prefix := strings.TrimSuffix(s, "*"); !strings.ContainsAny(prefix, "*?[\\") {
+			mode, s = OP_PREFIX, prefix
+		}
+		q, err := p.where(field, k, mode, s)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+	if len(plain) > 0 {
+		q, err := p.where(field, k, op, plain...)
+		if err != nil {
+			return nil, err
+		}
+		or = append(or, q)
+	}
+	if len(or) == 1 {
+		return or[0], nil
+	}
+	return or, nil
+}
+
+func (p *queryParser) where(field token, k Key, op Op, values ...interface{}) (Query, error) {
+	pred, err := Where(k, op, values...)
+	if err != nil {
+		return nil, p.errorf(field, "%v", err)
+	}
+	return pred, nil
+}
+
+func (p *queryParser) parseValue(k Key) (interface{}, error) {
+	t := p.next()
+	if t.kind != tokWord && t.kind != tokString {
+		return nil, p.errorf(t, "expected a value for %s, found %q", k, t.text)
+	}
+	v, err := DefaultSchema.Parse(k, t.text)
+	if err != nil {
+		return nil, p.errorf(t, "%v", err)
+	}
+	return v, nil
+}
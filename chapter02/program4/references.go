@@ -0,0 +1,814 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Reference managers exchange books as BibTeX @book entries and RIS
+// records of type BOOK. Both carry the title, the authors as
+// "Last, First", the year, the ISBN and keywords. A keyword naming a value
+// of an enum key, such as "horror" or "China", sets that key, so an
+// exported list imports back unchanged; keys a reference does not give
+// are taken from the defaults passed to the importer.
+
+// reference is a BibTeX entry or RIS record on its way to Attributes.
+type reference struct {
+	line     int
+	typ      string
+	title    string
+	authors  []string
+	year     string
+	isbn     string
+	keywords []string
+}
+
+// ImportBibTeX adds a book for each @book entry and reports the other
+// entries, and the entries that do not make a valid book, by line number.
+func (c *Catalogue) ImportBibTeX(r io.Reader, defaults map[Key]interface{}) (*ImportReport, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	refs, errs := parseBibTeX(string(data))
+	return c.importReferences(refs, errs, "book", defaults)
+}
+
+// ImportRIS adds a book for each record of type BOOK and reports the
+// others like ImportBibTeX.
+func (c *Catalogue) ImportRIS(r io.Reader, defaults map[Key]interface{}) (*ImportReport, error) {
+	refs, errs, err := parseRIS(r)
+	if err != nil {
+		return nil, err
+	}
+	return c.importReferences(refs, errs, "BOOK", defaults)
+}
+
+func (c *Catalogue) importReferences(refs []reference, errs []LineError, typ string, defaults map[Key]interface{}) (*ImportReport, error) {
+	report := &ImportReport{Rejected: errs}
+	for _, ref := range refs {
+		if ref.typ != typ {
+			report.Rejected = append(report.Rejected, LineError{Line: ref.line, Err: fmt.Errorf("%s is not a book", ref.typ)})
+			continue
+		}
+		attrs, err := ref.attributes(defaults)
+		if err != nil {
+			report.Rejected = append(report.Rejected, LineError{Line: ref.line, Err: err})
+			continue
+		}
+		id, err := c.add(attrs)
+		var dup *DuplicateError
+		if errors.As(err, &dup) {
+			report.Rejected = append(report.Rejected, LineError{Line: ref.line, Err: err})
+			continue
+		}
+		if err != nil {
+			return report, err
+		}
+		report.Added = append(report.Added, id)
+	}
+	sort.SliceStable(report.Rejected, func(i, j int) bool { return report.Rejected[i].Line < report.Rejected[j].Line })
+	return report, c.Sync()
+}
+
+func (ref *reference) attributes(defaults map[Key]interface{}) (*Attributes, error) {
+	pairs := map[Key]interface{}{}
+	if ref.title != "" {
+		pairs[KEY_TITLE] = ref.title
+	}
+	var lasts, firsts []interface{}
+	for _, name := range ref.authors {
+		last, first, _ := strings.Cut(name, ",")
+		lasts = append(lasts, strings.TrimSpace(last))
+		if first = strings.TrimSpace(first); first != "" {
+			firsts = append(firsts, first)
+		}
+	}
+	if len(lasts) > 0 {
+		pairs[KEY_LAST] = lasts
+	}
+	// FIRST[i] goes with LAST[i]
+	if len(firsts) == len(lasts) && len(firsts) > 0 {
+		pairs[KEY_FIRST] = firsts
+	}
+	if ref.year != "" {
+		year, err := strconv.Atoi(yearPattern.FindString(ref.year))
+		if err != nil {
+			return nil, fmt.Errorf("invalid year %q", ref.year)
+		}
+		pairs[KEY_YEAR] = year
+	}
+	if ref.isbn != "" {
+		isbn, err := ParseISBN(isbnPattern.FindString(ref.isbn))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ISBN %q", ref.isbn)
+		}
+		pairs[KEY_ISBN] = isbn
+	}
+	for _, word := range ref.keywords {
+		for _, k := range DefaultSchema.Keys() {
+			if spec, _ := DefaultSchema.Spec(k); spec.Type != TYPE_ENUM {
+				continue
+			}
+			v, err := DefaultSchema.Parse(k, word)
+			if err != nil {
+				continue
+			}
+			if !DefaultSchema.multi(k) {
+				if _, set := pairs[k]; !set {
+					pairs[k] = v
+				}
+			} else if list, _ := pairs[k].([]interface{}); !containsValue(list, v, Folding{}) {
+				pairs[k] = append(list, v)
+			}
+			break
+		}
+	}
+	kind, _ := pairs[KEY_KIND].(Kind)
+	if _, set := pairs[KEY_KIND]; !set {
+		kind, _ = defaults[KEY_KIND].(Kind)
+	}
+	for k, v := range defaults {
+		if _, set := pairs[k]; !set && DefaultSchema.allows(kind, k) {
+			pairs[k] = v
+		}
+	}
+	attrs, err := NewAttributes(pairs)
+	if err != nil {
+		return nil, err
+	}
+	return attrs, DefaultSchema.CheckBook(attrs)
+}
+
+// ExportBibTeX writes the books q matches, or every book for a nil q, as
+// BibTeX @book entries.
+func (c *Catalogue) ExportBibTeX(w io.Writer, q Query) error {
+	books := c.Books()
+	if q != nil {
+		books = c.Find(q)
+	}
+	return WriteBibTeX(w, books)
+}
+
+// ExportRIS writes the books q matches, or every book for a nil q, as RIS.
+func (c *Catalogue) ExportRIS(w io.Writer, q Query) error {
+	books := c.Books()
+	if q != nil {
+		books = c.Find(q)
+	}
+	return WriteRIS(w, books)
+}
+
+// WriteBibTeX writes books as @book entries under their citation keys.
+func WriteBibTeX(w io.Writer, books []*Book) error {
+	bw := bufio.NewWriter(w)
+	for i, key := range CitationKeys(books) {
+		attrs := books[i].Attrs
+		if i > 0 {
+			bw.WriteString("\n")
+		}
+		fmt.Fprintf(bw, "@book{%s,\n", key)
+		if title, ok := attrs.attrMap[KEY_TITLE].(string); ok {
+			fmt.Fprintf(bw, "  title = {%s},\n", bibEscape(title))
+		}
+		if names := authorNames(attrs); len(names) > 0 {
+			for j, name := range names {
+				last, first, _ := strings.Cut(name, ", ")
+				names[j] = bibEscape(last)
+				if strings.Contains(last, " and ") || strings.Contains(last, ",") {
+					names[j] = "{" + names[j] + "}"
+				}
+				if first != "" {
+					names[j] += ", " + bibEscape(first)
+				}
+			}
+			fmt.Fprintf(bw, "  author = {%s},\n", strings.Join(names, " and "))
+		}
+		if year, ok := attrs.attrMap[KEY_YEAR].(int); ok {
+			fmt.Fprintf(bw, "  year = {%d},\n", year)
+		}
+		if isbn, ok := attrs.attrMap[KEY_ISBN].(ISBN); ok {
+			fmt.Fprintf(bw, "  isbn = {%s},\n", isbn)
+		}
+		if words := keywords(attrs); len(words) > 0 {
+			fmt.Fprintf(bw, "  keywords = {%s},\n", bibEscape(strings.Join(words, ", ")))
+		}
+		bw.WriteString("}\n")
+	}
+	return bw.Flush()
+}
+
+// WriteRIS writes books as RIS records of type BOOK, with the citation key
+// as the ID.
+func WriteRIS(w io.Writer, books []*Book) error {
+	bw := bufio.NewWriter(w)
+	for i, key := range CitationKeys(books) {
+		attrs := books[i].Attrs
+		fmt.Fprintf(bw, "TY  - BOOK\r\nID  - %s\r\n", key)
+		if title, ok := attrs.attrMap[KEY_TITLE].(string); ok {
+			fmt.Fprintf(bw, "TI  - %s\r\n", title)
+		}
+		for _, name := range authorNames(attrs) {
+			fmt.Fprintf(bw, "AU  - %s\r\n", name)
+		}
+		if year, ok := attrs.attrMap[KEY_YEAR].(int); ok {
+			fmt.Fprintf(bw, "PY  - %d\r\n", year)
+		}
+		if isbn, ok := attrs.attrMap[KEY_ISBN].(ISBN); ok {
+			fmt.Fprintf(bw, "SN  - %s\r\n", isbn)
+		}
+		for _, word := range keywords(attrs) {
+			fmt.Fprintf(bw, "KW  - %s\r\n", word)
+		}
+		bw.WriteString("ER  - \r\n")
+	}
+	return bw.Flush()
+}
+
+// authorNames pairs each LAST with its FIRST as "Last, First".
+func authorNames(attrs *Attributes) []string {
+	lasts, firsts := attrs.values(KEY_LAST), attrs.values(KEY_FIRST)
+	names := make([]string, len(lasts))
+	for i, last := range lasts {
+		names[i] = last.(string)
+		if i < len(firsts) {
+			names[i] += ", " + firsts[i].(string)
+		}
+	}
+	return names
+}
+
+// keywords names the enum values of a book, KIND first.
+func keywords(attrs *Attributes) []string {
+	var words []string
+	for _, k := range attrs.sortedKeys() {
+		if spec, _ := DefaultSchema.Spec(k); spec.Type == TYPE_ENUM {
+			for _, v := range attrs.values(k) {
+				words = append(words, DefaultSchema.Format(k, v))
+			}
+		}
+	}
+	return words
+}
+
+// CitationKeys makes a key for each book from the first author's last
+// name, the year and the first word of the title that is not an article,
+// spelled in lower case ASCII, such as "king1974carrie". Books that would
+// share a key are told apart by letters: king1984talisman,
+// king1984talismanb, and after king1984talismanz, king1984talismanaa.
+func CitationKeys(books []*Book) []string {
+	ascii := Folding{Transliterate: true}
+	keys := make([]string, len(books))
+	used := map[string]bool{}
+	for i, book := range books {
+		var sb strings.Builder
+		if lasts := book.Attrs.values(KEY_LAST); len(lasts) > 0 {
+			sb.WriteString(citationWord(ascii.Fold(lasts[0].(string))))
+		}
+		if year, ok := book.Attrs.attrMap[KEY_YEAR].(int); ok {
+			sb.WriteString(strconv.Itoa(year))
+		}
+		if title, ok := book.Attrs.attrMap[KEY_TITLE].(string); ok {
+			for _, w := range ascii.tokenize(title) {
+				if word := citationWord(w.term); word != "" && !articles[w.term] {
+					sb.WriteString(word)
+					break
+				}
+			}
+		}
+		key := sb.String()
+		if key == "" {
+			key = fmt.Sprintf("book%d", book.ID)
+		}
+		base := key
+		for n := 2; used[key]; n++ {
+			key = base + letters(n)
+		}
+		used[key] = true
+		keys[i] = key
+	}
+	return keys
+}
+
+// letters numbers 1, 2, ... 26, 27 as a, b, ... z, aa.
+func letters(n int) string {
+	var b []byte
+	for ; n > 0; n = (n - 1) / 26 {
+		b = append([]byte{byte('a' + (n-1)%26)}, b...)
+	}
+	return string(b)
+}
+
+// articles are skipped at the start of a title in a citation key.
+var articles = map[string]bool{"a": true, "an": true, "the": true}
+
+// citationWord keeps the ASCII letters and digits of s, in lower case.
+func citationWord(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case 'a' <= r && r <= 'z', '0' <= r && r <= '9':
+			return r
+		case 'A' <= r && r <= 'Z':
+			return r + 'a' - 'A'
+		}
+		return -1
+	}, s)
+}
+
+// bibEscape protects the characters BibTeX and LaTeX treat specially.
+func bibEscape(s string) string {
+	return strings.NewReplacer(`\`, `\textbackslash{}`, "{", `\{`, "}", `\}`, "&", `\&`,
+		"%", `\%`, "$", `\$`, "#", `\#`, "_", `\_`, "~", `\textasciitilde{}`).Replace(s)
+}
+
+// bibScanner reads BibTeX, keeping count of lines.
+type bibScanner struct {
+	s    string
+	pos  int
+	line int
+}
+
+func (sc *bibScanner) next() byte {
+	b := sc.s[sc.pos]
+	if b == '\n' {
+		sc.line++
+	}
+	sc.pos++
+	return b
+}
+
+func (sc *bibScanner) skipSpace() {
+	for sc.pos < len(sc.s) && strings.IndexByte(" \t\r\n", sc.s[sc.pos]) >= 0 {
+		sc.next()
+	}
+}
+
+func (sc *bibScanner) ident() string {
+	start := sc.pos
+	for sc.pos < len(sc.s) && !strings.ContainsRune(" \t\r\n{}(),=#\"@", rune(sc.s[sc.pos])) {
+		sc.next()
+	}
+	return sc.s[start:sc.pos]
+}
+
+func (sc *bibScanner) expect(b byte) error {
+	sc.skipSpace()
+	if sc.pos == len(sc.s) {
+		return fmt.Errorf("want %q, got end of input", b)
+	}
+	if got := sc.s[sc.pos]; got != b {
+		return fmt.Errorf("want %q, got %q", b, got)
+	}
+	sc.next()
+	return nil
+}
+
+var bibMonths = map[string]string{
+	"jan": "January", "feb": "February", "mar": "March", "apr": "April", "may": "May", "jun": "June",
+	"jul": "July", "aug": "August", "sep": "September", "oct": "October", "nov": "November", "dec": "December",
+}
+
+// parseBibTeX reads the entries of a BibTeX file. Text outside entries is
+// a comment. @string abbreviations are expanded and @comment and
+// @preamble skipped. An entry with a syntax error is reported and the
+// rest of it skipped.
+func parseBibTeX(text string) ([]reference, []LineError) {
+	sc := &bibScanner{s: text, line: 1}
+	macros := map[string]string{}
+	for name, month := range bibMonths {
+		macros[name] = month
+	}
+	var refs []reference
+	var errs []LineError
+	for {
+		i := strings.IndexByte(sc.s[sc.pos:], '@')
+		if i < 0 {
+			return refs, errs
+		}
+		for ; i > 0; i-- {
+			sc.next()
+		}
+		sc.next()
+		line := sc.line
+		typ := strings.ToLower(sc.ident())
+		fields, err := sc.entry(typ, macros)
+		if err != nil {
+			errs = append(errs, LineError{Line: line, Err: fmt.Errorf("@%s: %v", typ, err)})
+			continue
+		}
+		switch typ {
+		case "comment", "preamble":
+		case "string":
+			for name, value := range fields {
+				macros[name] = value
+			}
+		default:
+			ref := reference{line: line, typ: typ, title: latexText(fields["title"]), year: fields["year"], isbn: fields["isbn"]}
+			if ref.year == "" {
+				ref.year = fields["date"]
+			}
+			for _, name := range splitBibAuthors(fields["author"]) {
+				ref.authors = append(ref.authors, bibName(name))
+			}
+			for _, word := range strings.FieldsFunc(fields["keywords"], func(r rune) bool { return r == ',' || r == ';' }) {
+				if word = latexText(word); word != "" {
+					ref.keywords = append(ref.keywords, word)
+				}
+			}
+			refs = append(refs, ref)
+		}
+	}
+}
+
+// entry reads the body of an entry after its type: the citation key and
+// the fields, or for @string the abbreviation, or for @comment and
+// @preamble anything. Field names are in lower case; values keep their
+// LaTeX.
+func (sc *bibScanner) entry(typ string, macros map[string]string) (map[string]string, error) {
+	sc.skipSpace()
+	if sc.pos == len(sc.s) || (sc.s[sc.pos] != '{' && sc.s[sc.pos] != '(') {
+		return nil, errors.New("want { after the entry type")
+	}
+	closing := byte('}')
+	if sc.next() == '(' {
+		closing = ')'
+	}
+	if typ == "comment" || typ == "preamble" {
+		_, err := sc.balanced(closing)
+		return nil, err
+	}
+	if typ != "string" {
+		sc.skipSpace()
+		sc.ident() // the citation key
+		sc.skipSpace()
+		if sc.pos < len(sc.s) && sc.s[sc.pos] == ',' {
+			sc.next()
+		}
+	}
+	fields := map[string]string{}
+	for {
+		sc.skipSpace()
+		if sc.pos == len(sc.s) {
+			return nil, errors.New("unexpected end of input")
+		}
+		if sc.s[sc.pos] == closing {
+			sc.next()
+			return fields, nil
+		}
+		name := strings.ToLower(sc.ident())
+		if name == "" {
+			return nil, fmt.Errorf("want a field name, got %q", sc.s[sc.pos])
+		}
+		if err := sc.expect('='); err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		value, err := sc.value(macros)
+		if err != nil {
+			return nil, fmt.Errorf("field %s: %v", name, err)
+		}
+		fields[name] = value
+		sc.skipSpace()
+		if sc.pos < len(sc.s) && sc.s[sc.pos] == ',' {
+			sc.next()
+		} else if sc.pos < len(sc.s) && sc.s[sc.pos] != closing {
+			return nil, fmt.Errorf("field %s: want , or %q, got %q", name, closing, sc.s[sc.pos])
+		}
+	}
+}
+
+// value reads a field value: braced or quoted text, a number or an
+// abbreviation, joined with #.
+func (sc *bibScanner) value(macros map[string]string) (string, error) {
+	var sb strings.Builder
+	for {
+		sc.skipSpace()
+		if sc.pos == len(sc.s) {
+			return "", errors.New("missing value")
+		}
+		switch b := sc.s[sc.pos]; {
+		case b == '{':
+			sc.next()
+			text, err := sc.balanced('}')
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(text)
+		case b == '"':
+			sc.next()
+			text, err := sc.balanced('"')
+			if err != nil {
+				return "", err
+			}
+			sb.WriteString(text)
+		default:
+			name := sc.ident()
+			if name == "" {
+				return "", fmt.Errorf("unexpected %q", b)
+			}
+			if _, err := strconv.Atoi(name); err == nil {
+				sb.WriteString(name)
+			} else if text, ok := macros[strings.ToLower(name)]; ok {
+				sb.WriteString(text)
+			} else {
+				return "", fmt.Errorf("undefined abbreviation %q", name)
+			}
+		}
+		sc.skipSpace()
+		if sc.pos == len(sc.s) || sc.s[sc.pos] != '#' {
+			return sb.String(), nil
+		}
+		sc.next()
+	}
+}
+
+// balanced reads up to the closing byte at brace depth zero and consumes
+// it. Braces escaped with a backslash do not count.
+func (sc *bibScanner) balanced(closing byte) (string, error) {
+	start, depth := sc.pos, 0
+	for sc.pos < len(sc.s) {
+		b := sc.next()
+		switch {
+		case b == '\\' && sc.pos < len(sc.s):
+			sc.next()
+		case b == closing && depth == 0:
+			return sc.s[start : sc.pos-1], nil
+		case b == '{':
+			depth++
+		case b == '}':
+			if depth == 0 {
+				return "", errors.New("unbalanced }")
+			}
+			depth--
+		}
+	}
+	return "", fmt.Errorf("missing closing %q", closing)
+}
+
+// splitBibAuthors splits an author list at the "and"s outside braces.
+func splitBibAuthors(s string) []string {
+	var names []string
+	depth, start := 0, 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ' ', '\t', '\n', '\r':
+			if depth == 0 && i+5 <= len(s) && strings.EqualFold(s[i+1:i+4], "and") && strings.ContainsRune(" \t\n\r", rune(s[i+4])) {
+				names = append(names, s[start:i])
+				start = i + 5
+				i += 4
+			}
+		}
+	}
+	names = append(names, s[start:])
+	var out []string
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// bibName turns a BibTeX name, "Last, First", "Last, Jr, First" or
+// "First von Last", into "Last, First". A braced group is one word.
+func bibName(name string) string {
+	var parts []string
+	depth, start := 0, 0
+	for i := 0; i < len(name); i++ {
+		switch name[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, name[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, name[start:])
+	if len(parts) > 1 {
+		return joinName(latexText(parts[0]), latexText(parts[len(parts)-1]))
+	}
+
+	var words []string
+	depth, start = 0, -1
+	for i := 0; i <= len(name); i++ {
+		if i == len(name) || (depth == 0 && unicode.IsSpace(rune(name[i]))) {
+			if start >= 0 {
+				words = append(words, name[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		switch name[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		}
+	}
+	if len(words) == 0 {
+		return ""
+	}
+	// the von part is the lower case words before the last one
+	last := len(words) - 1
+	for last > 0 && startsLower(words[last-1]) {
+		last--
+	}
+	return joinName(latexText(strings.Join(words[last:], " ")), latexText(strings.Join(words[:last], " ")))
+}
+
+func startsLower(word string) bool {
+	r, _ := utf8.DecodeRuneInString(word)
+	return unicode.IsLower(r)
+}
+
+func joinName(last, first string) string {
+	if first == "" {
+		return last
+	}
+	return last + ", " + first
+}
+
+// latexAccents are the marks made by LaTeX accent commands such as \'e.
+var latexAccents = map[string]rune{
+	"'": 0x0301, "`": 0x0300, "^": 0x0302, `"`: 0x0308, "~": 0x0303, "=": 0x0304, ".": 0x0307,
+	"c": 0x0327, "v": 0x030C, "u": 0x0306, "H": 0x030B, "k": 0x0328, "r": 0x030A, "d": 0x0323, "b": 0x0331,
+}
+
+// latexSymbols are the letters and characters LaTeX commands stand for.
+var latexSymbols = map[string]string{
+	"ss": "ß", "o": "ø", "O": "Ø", "ae": "æ", "AE": "Æ", "oe": "œ", "OE": "Œ", "aa": "å", "AA": "Å",
+	"l": "ł", "L": "Ł", "i": "ı", "j": "ȷ", "&": "&", "%": "%", "$": "$", "#": "#", "_": "_",
+	"{": "{", "}": "}", " ": " ", "textbackslash": `\`, "textasciitilde": "~",
+}
+
+// latexText turns the LaTeX of a field into plain text: accent commands
+// become accented letters, braces are dropped and other commands are left
+// out in favour of their argument.
+func latexText(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); {
+		switch b := s[i]; b {
+		case '{', '}':
+			i++
+		case '~':
+			sb.WriteByte(' ')
+			i++
+		case '\\':
+			i++
+			start := i
+			for i < len(s) && isLetter(s[i]) {
+				i++
+			}
+			if i == start && i < len(s) {
+				i++ // a command of one symbol
+			}
+			name := s[start:i]
+			if mark, ok := latexAccents[name]; ok {
+				var base string
+				base, i = latexArgument(s, i)
+				if base == "ı" || base == "ȷ" {
+					base = map[string]string{"ı": "i", "ȷ": "j"}[base]
+				}
+				sb.WriteString(base)
+				sb.WriteRune(mark)
+				continue
+			}
+			if symbol, ok := latexSymbols[name]; ok {
+				sb.WriteString(symbol)
+				if isLetter(name[0]) && strings.HasPrefix(s[i:], "{}") {
+					i += 2
+				}
+				continue
+			}
+			for i < len(s) && s[i] == ' ' && isLetter(name[0]) {
+				i++
+			}
+		default:
+			sb.WriteByte(b)
+			i++
+		}
+	}
+	return norm.NFC.String(strings.Join(strings.Fields(sb.String()), " "))
+}
+
+// latexArgument returns the letter an accent applies to, written plainly,
+// in braces or as a command such as \i, and where the text after it starts.
+func latexArgument(s string, i int) (string, int) {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	if i == len(s) {
+		return "", i
+	}
+	if s[i] == '{' {
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return latexText(s[i+1:]), len(s)
+		}
+		return latexText(s[i+1 : i+end]), i + end + 1
+	}
+	if s[i] == '\\' {
+		j := i + 1
+		for j < len(s) && isLetter(s[j]) {
+			j++
+		}
+		return latexText(s[i:j]), j
+	}
+	_, size := utf8.DecodeRuneInString(s[i:])
+	return s[i : i+size], i + size
+}
+
+func isLetter(b byte) bool { return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z' }
+
+// parseRIS reads RIS records: lines of a two-character tag, two spaces, a
+// hyphen and a value, from TY to ER. A line without a tag continues the
+// value before it.
+func parseRIS(r io.Reader) ([]reference, []LineError, error) {
+	sc := bufio.NewScanner(r)
+	var refs []reference
+	var errs []LineError
+	var ref *reference
+	var last *string
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), " \r")
+		if n == 1 {
+			line = strings.TrimPrefix(line, "\uFEFF")
+		}
+		tag, value, tagged := risLine(line)
+		switch {
+		case !tagged && ref != nil && last != nil && line != "":
+			*last += " " + strings.TrimSpace(line)
+			continue
+		case !tagged:
+			continue
+		case tag == "TY":
+			if ref != nil {
+				errs = append(errs, LineError{Line: ref.line, Err: errors.New("record has no ER")})
+			}
+			ref = &reference{line: n, typ: value}
+			last = nil
+			continue
+		case ref == nil:
+			errs = append(errs, LineError{Line: n, Err: fmt.Errorf("%s outside a record", tag)})
+			continue
+		}
+		last = nil
+		switch tag {
+		case "TI", "T1", "BT":
+			if ref.title == "" {
+				ref.title = value
+				last = &ref.title
+			}
+		case "AU", "A1":
+			ref.authors = append(ref.authors, value)
+			last = &ref.authors[len(ref.authors)-1]
+		case "PY", "Y1", "DA":
+			if ref.year == "" {
+				ref.year = value
+			}
+		case "SN":
+			if ref.isbn == "" {
+				ref.isbn = value
+			}
+		case "KW":
+			ref.keywords = append(ref.keywords, value)
+		case "ER":
+			refs = append(refs, *ref)
+			ref = nil
+		}
+	}
+	if ref != nil {
+		errs = append(errs, LineError{Line: ref.line, Err: errors.New("record has no ER")})
+	}
+	return refs, errs, sc.Err()
+}
+
+// risLine splits a tagged line such as "TI  - Dune".
+func risLine(line string) (tag, value string, ok bool) {
+	if len(line) < 5 || line[2:5] != "  -" || !isLetter(line[0]) {
+		return "", "", false
+	}
+	if c := line[1]; !isLetter(c) && !('0' <= c && c <= '9') {
+		return "", "", false
+	}
+	return strings.ToUpper(line[:2]), strings.TrimSpace(line[5:]), true
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// TestReferenceRoundTrip exports the sample books and imports them into
+// an empty catalogue, which must then hold the same books.
+func TestReferenceRoundTrip(t *testing.T) {
+	c := sampleCatalogue(t)
+	for _, format := range []struct {
+		name   string
+		export func(*Catalogue, io.Writer) error
+		load   func(*Catalogue, io.Reader) (*ImportReport, error)
+	}{
+		{"BibTeX",
+			func(c *Catalogue, w io.Writer) error { return c.ExportBibTeX(w, nil) },
+			func(c *Catalogue, r io.Reader) (*ImportReport, error) { return c.ImportBibTeX(r, nil) }},
+		{"RIS",
+			func(c *Catalogue, w io.Writer) error { return c.ExportRIS(w, nil) },
+			func(c *Catalogue, r io.Reader) (*ImportReport, error) { return c.ImportRIS(r, nil) }},
+	} {
+		var buf bytes.Buffer
+		if err := format.export(c, &buf); err != nil {
+			t.Fatal(err)
+		}
+		text := buf.String()
+		copied := &Catalogue{}
+		report, err := format.load(copied, &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Rejected) > 0 {
+			t.Errorf("%s: %s", format.name, report)
+		}
+		want, got := c.Books(), copied.Books()
+		if len(got) != len(want) {
+			t.Errorf("%s: %d books came back, want %d", format.name, len(got), len(want))
+			continue
+		}
+		for i := range want {
+			if got[i].String() != want[i].String() {
+				t.Errorf("%s: book %d came back as %s, want %s\n%s", format.name, i+1, got[i], want[i], text)
+			}
+		}
+	}
+}
+
+func TestImportBibTeX(t *testing.T) {
+	const input = `@article{x, title={Nope}}
+@book{zola, title = {Th{\'e}r{\` + "`" + `e}se Raquin}, author = {Zola, {\'E}mile}, year = 1867, keywords = {classics}}
+@book{omens, title = "Good Omens", author = {Terry Pratchett and Neil Gaiman}, year = {1990}, keywords={fantasy}}
+@book{bad, title = {No Author}}
+@book{broken, title = {x`
+	c := &Catalogue{}
+	report, err := c.ImportBibTeX(strings.NewReader(input), M{KEY_KIND: FICTION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []int
+	for _, le := range report.Rejected {
+		lines = append(lines, le.Line)
+	}
+	if len(report.Added) != 2 || !reflect.DeepEqual(lines, []int{1, 4, 5}) {
+		t.Errorf("report:\n%s", report)
+	}
+	const want = "{KIND: fiction, TITLE: 'Thérèse Raquin', LAST: 'Zola', FIRST: 'Émile', YEAR: 1867, GENRE: classics}\n" +
+		"{KIND: fiction, TITLE: 'Good Omens', LAST: ['Pratchett', 'Gaiman'], FIRST: ['Terry', 'Neil'], YEAR: 1990, GENRE: fantasy}\n"
+	if got := booksString(c); got != want {
+		t.Errorf("imported\n%swant\n%s", got, want)
+	}
+}
+
+func TestImportRIS(t *testing.T) {
+	const input = "TY  - JOUR\nTI  - Paper\nER  - \n" +
+		"TY  - BOOK\nTI  - Carrie\nAU  - King, Stephen\nPY  - 1974/04/05\nSN  - 0-385-08695-4\nKW  - horror\nER  - \n" +
+		"TY  - BOOK\nTI  - x\nER  - \n"
+	c := &Catalogue{}
+	report, err := c.ImportRIS(strings.NewReader(input), M{KEY_KIND: FICTION})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Added) != 1 || len(report.Rejected) != 2 || report.Rejected[0].Line != 1 || report.Rejected[1].Line != 11 {
+		t.Errorf("report:\n%s", report)
+	}
+	const want = "{KIND: fiction, TITLE: 'Carrie', LAST: 'King', FIRST: 'Stephen', YEAR: 1974, GENRE: horror, ISBN: 9780385086950}\n"
+	if got := booksString(c); got != want {
+		t.Errorf("imported %s, want %s", got, want)
+	}
+}
+
+func booksString(c *Catalogue) string {
+	var sb strings.Builder
+	for _, book := range c.Books() {
+		sb.WriteString(book.String() + "\n")
+	}
+	return sb.String()
+}
+
+func TestCitationKeys(t *testing.T) {
+	book := func(id int, pairs M) *Book {
+		pairs[KEY_KIND], pairs[KEY_GENRE] = FICTION, HORROR
+		return &Book{ID: id, Attrs: MustAttributes(pairs)}
+	}
+	talisman := M{KEY_TITLE: "The Talisman", KEY_LAST: []string{"King", "Straub"}, KEY_YEAR: 1984}
+	books := []*Book{
+		book(1, M{KEY_TITLE: "Carrie", KEY_LAST: "King", KEY_YEAR: 1974}),
+		book(2, M{KEY_TITLE: "A Tale of Two Cities", KEY_LAST: "Dickens"}),
+		book(3, M{KEY_TITLE: "Дама с собачкой", KEY_LAST: "Чехов", KEY_YEAR: 1899}),
+		book(4, M{KEY_TITLE: "Ender's Game", KEY_LAST: "Card"}),
+		book(5, M{KEY_TITLE: "2001: A Space Odyssey", KEY_LAST: "Clarke", KEY_YEAR: 1968}),
+		book(6, M{KEY_TITLE: "The", KEY_LAST: "Ó'Brien"}),
+		book(7, M{KEY_TITLE: "¿?", KEY_LAST: "—"}),
+	}
+	want := []string{"king1974carrie", "dickenstale", "chekhov1899dama", "cardender", "clarke19682001", "obrien", "book7"}
+	for i := 0; i < 28; i++ {
+		books = append(books, book(8+i, talisman))
+	}
+	want = append(want, "king1984talisman", "king1984talismanb", "king1984talismanc")
+	got := CitationKeys(books)
+	if !reflect.DeepEqual(got[:len(want)], want) {
+		t.Errorf("CitationKeys = %v, want %v", got[:len(want)], want)
+	}
+	if last := got[len(got)-1]; last != "king1984talismanab" {
+		t.Errorf("28th Talisman key is %q, want king1984talismanab", last)
+	}
+	if z := got[len(got)-3]; z != "king1984talismanz" {
+		t.Errorf("26th Talisman key is %q, want king1984talismanz", z)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Report is a table of aggregates. A cell holds a string, an int, a
+// float64 or nil when there is nothing to show, such as the median year of
+// a group with no dated books.
+type Report struct {
+	Title   string
+	Columns []string
+	Rows    [][]interface{}
+}
+
+// GroupStats summarizes a group of books.
+type GroupStats struct {
+	Label    string
+	Books    int
+	Dated    int // books with a YEAR
+	Earliest int
+	Latest   int
+	Median   float64
+}
+
+// GroupBy aggregates the books q matches by their value of k; a nil q
+// takes every book. A book with several values is counted in the group of
+// each, and authors are grouped by LAST and FIRST together. Books without
+// k are left out. The largest groups come first.
+func (c *Catalogue) GroupBy(k Key, q Query) ([]GroupStats, error) {
+	stats, _, err := c.groupBy(k, q)
+	return stats, err
+}
+
+// groupBy is GroupBy also returning the totals over every book with k.
+func (c *Catalogue) groupBy(k Key, q Query) ([]GroupStats, GroupStats, error) {
+	if _, ok := DefaultSchema.Spec(k); !ok {
+		return nil, GroupStats{}, fmt.Errorf("unknown key %s", k)
+	}
+	c.mu.RLock()
+	books := c.booklist
+	if q != nil {
+		books = c.find(q)
+	}
+	type group struct {
+		label string
+		books int
+		years []int
+	}
+	groups := map[interface{}]*group{}
+	total := &group{label: "all"}
+	for _, book := range books {
+		vals := book.Attrs.values(k)
+		if len(vals) == 0 {
+			continue
+		}
+		year, dated := book.Attrs.attrMap[KEY_YEAR].(int)
+		total.books++
+		if dated {
+			total.years = append(total.years, year)
+		}
+		for i, v := range vals {
+			label := DefaultSchema.Format(k, v)
+			if k == KEY_LAST {
+				if first := book.Attrs.values(KEY_FIRST); i < len(first) {
+					label += ", " + first[i].(string)
+				}
+			}
+			term := c.index.folding.term(label)
+			g := groups[term]
+			if g == nil {
+				g = &group{label: label}
+				groups[term] = g
+			}
+			g.books++
+			if dated {
+				g.years = append(g.years, year)
+			}
+		}
+	}
+	c.mu.RUnlock()
+
+	stats := make([]GroupStats, 0, len(groups))
+	for _, g := range groups {
+		stats = append(stats, summarize(g.label, g.books, g.years))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Books != stats[j].Books {
+			return stats[i].Books > stats[j].Books
+		}
+		return Collate(stats[i].Label, stats[j].Label) < 0
+	})
+	return stats, summarize(total.label, total.books, total.years), nil
+}
+
+func summarize(label string, books int, years []int) GroupStats {
+	s := GroupStats{Label: label, Books: books, Dated: len(years)}
+	if len(years) == 0 {
+		return s
+	}
+	sort.Ints(years)
+	s.Earliest, s.Latest = years[0], years[len(years)-1]
+	mid := len(years) / 2
+	if len(years)%2 == 1 {
+		s.Median = float64(years[mid])
+	} else {
+		s.Median = float64(years[mid-1]+years[mid]) / 2
+	}
+	return s
+}
+
+// GroupReport tabulates GroupBy with a last row for all the books.
+func (c *Catalogue) GroupReport(k Key, q Query) (*Report, error) {
+	stats, total, err := c.groupBy(k, q)
+	if err != nil {
+		return nil, err
+	}
+	r := &Report{
+		Title:   fmt.Sprintf("Books by %s", k),
+		Columns: []string{strings.ToLower(k.String()), "books", "earliest", "latest", "median"},
+	}
+	if q != nil {
+		r.Title += fmt.Sprintf(" where %s", q)
+	}
+	for _, s := range append(stats, total) {
+		row := []interface{}{s.Label, s.Books, nil, nil, nil}
+		if s.Dated > 0 {
+			row[2], row[3], row[4] = s.Earliest, s.Latest, s.Median
+		}
+		r.Rows = append(r.Rows, row)
+	}
+	return r, nil
+}
+
+// Write renders the report as "text", an aligned table, as "csv" with a
+// header line, or as "json", an array of objects keyed by column.
+func (r *Report) Write(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		return r.writeText(w)
+	case "csv":
+		return r.writeCSV(w)
+	case "json":
+		return r.writeJSON(w)
+	}
+	return fmt.Errorf("unknown report format %q (want text, csv or json)", format)
+}
+
+// writeText aligns the columns, numbers to the right.
+func (r *Report) writeText(w io.Writer) error {
+	widths := make([]int, len(r.Columns))
+	numeric := make([]bool, len(r.Columns))
+	rule := make([]string, len(r.Columns))
+	for i, col := range r.Columns {
+		widths[i] = utf8.RuneCountInString(col)
+		numeric[i] = true
+	}
+	for _, row := range r.Rows {
+		for i, cell := range row {
+			widths[i] = max(widths[i], utf8.RuneCountInString(formatCell(cell, "-")))
+			if _, text := cell.(string); text {
+				numeric[i] = false
+			}
+		}
+	}
+	for i := range rule {
+		rule[i] = strings.Repeat("-", widths[i])
+	}
+
+	var sb strings.Builder
+	line := func(cells []string) {
+		aligned := make([]string, len(cells))
+		for i, cell := range cells {
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell))
+			if numeric[i] {
+				aligned[i] = pad + cell
+			} else {
+				aligned[i] = cell + pad
+			}
+		}
+		sb.WriteString(strings.TrimRight(strings.Join(aligned, "  "), " ") + "\n")
+	}
+	if r.Title != "" {
+		sb.WriteString(r.Title + "\n")
+	}
+	line(r.Columns)
+	line(rule)
+	for _, row := range r.Rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = formatCell(cell, "-")
+		}
+		line(cells)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (r *Report) writeCSV(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write(r.Columns)
+	for _, row := range r.Rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			cells[i] = formatCell(cell, "")
+		}
+		cw.Write(cells)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *Report) writeJSON(w io.Writer) error {
+	var buf bytes.Buffer
+	buf.WriteString("[")
+	for n, row := range r.Rows {
+		if n > 0 {
+			buf.WriteString(",")
+		}
+		buf.WriteString("\n  {")
+		for i, cell := range row {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			name, _ := json.Marshal(r.Columns[i])
+			value, err := json.Marshal(cell)
+			if err != nil {
+				return err
+			}
+			buf.Write(name)
+			buf.WriteString(": ")
+			buf.Write(value)
+		}
+		buf.WriteString("}")
+	}
+	buf.WriteString("\n]\n")
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatCell shows a cell, or none for nil.
+func formatCell(cell interface{}, none string) string {
+	switch v := cell.(type) {
+	case nil:
+		return none
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(cell)
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ValueType is the type of value a Key holds.
+type ValueType int
+
+const (
+	TYPE_INT ValueType = iota
+	TYPE_STRING
+	TYPE_ENUM
+	TYPE_ISBN
+)
+
+var valueTypeNames = [...]string{"int", "string", "enum", "isbn"}
+
+func (t ValueType) String() string { return valueTypeNames[t] }
+
+// KeySpec describes one attribute key.
+type KeySpec struct {
+	Key    Key
+	Name   string
+	Type   ValueType
+	Values []string     // vocabulary of an enum key
+	Multi  bool         // holds an ordered list of values
+	Text   bool         // free text, indexed word by word for Search
+	goType reflect.Type // Go type of the values stored under the key
+}
+
+// KindSpec lists the keys a book of one Kind must carry and may carry.
+// KIND itself is always allowed.
+type KindSpec struct {
+	Required []Key
+	Optional []Key
+}
+
+// Schema is the registry of attribute keys, their value types and enum
+// vocabularies, and the keys each Kind of book uses. Keys and values are
+// only ever added, so a Key or enum value stays valid once registered.
+type Schema struct {
+	mu     sync.RWMutex
+	keys   []*KeySpec
+	byName map[string]Key
+	kinds  map[Kind]*KindSpec
+}
+
+// DefaultSchema holds the built-in keys and is used by NewAttributes and
+// Catalogue.Add.
+var DefaultSchema = builtinSchema()
+
+func NewSchema() *Schema {
+	return &Schema{byName: map[string]Key{}, kinds: map[Kind]*KindSpec{}}
+}
+
+func builtinSchema() *Schema {
+	s := NewSchema()
+	s.register("KIND", TYPE_ENUM, reflect.TypeOf(FICTION), []string{"fiction", "cookbook", "howto"})
+	s.register("TITLE", TYPE_STRING, reflect.TypeOf(""), nil)
+	s.register("LAST", TYPE_STRING, reflect.TypeOf(""), nil)
+	s.register("FIRST", TYPE_STRING, reflect.TypeOf(""), nil)
+	s.register("YEAR", TYPE_INT, reflect.TypeOf(0), nil)
+	s.register("GENRE", TYPE_ENUM, reflect.TypeOf(ADVENTURE),
+		[]string{"adventure", "classics", "detective", "fantasy", "historic", "horror", "romance", "scifi"})
+	s.register("REGION", TYPE_ENUM, reflect.TypeOf(CHINA),
+		[]string{"China", "France", "India", "Italy", "Mexico", "Persia", "US"})
+	s.register("SUBJECT", TYPE_ENUM, reflect.TypeOf(DRAWING), []string{"drawing", "painting", "writing"})
+	s.register("ISBN", TYPE_ISBN, reflect.TypeOf(ISBN("")), nil)
+	// LAST and FIRST list the authors in order, so FIRST[i] goes with LAST[i].
+	for _, k := range []Key{KEY_LAST, KEY_FIRST, KEY_REGION} {
+		s.keys[k].Multi = true
+	}
+	s.keys[KEY_TITLE].Text = true
+
+	s.kinds[FICTION] = &KindSpec{
+		Required: []Key{KEY_TITLE, KEY_LAST, KEY_GENRE},
+		Optional: []Key{KEY_FIRST, KEY_YEAR, KEY_ISBN},
+	}
+	s.kinds[COOKBOOK] = &KindSpec{
+		Required: []Key{KEY_TITLE, KEY_LAST, KEY_REGION},
+		Optional: []Key{KEY_FIRST, KEY_YEAR, KEY_ISBN},
+	}
+	s.kinds[HOWTO] = &KindSpec{
+		Required: []Key{KEY_TITLE, KEY_LAST, KEY_SUBJECT},
+		Optional: []Key{KEY_FIRST, KEY_YEAR, KEY_ISBN},
+	}
+	return s
+}
+
+func (s *Schema) register(name string, t ValueType, goType reflect.Type, values []string) Key {
+	k := Key(len(s.keys))
+	s.keys = append(s.keys, &KeySpec{Key: k, Name: name, Type: t, Values: values, goType: goType})
+	s.byName[strings.ToUpper(name)] = k
+	return k
+}
+
+// RegisterKey adds a key holding values of type t. An enum key takes its
+// vocabulary from values; its values are stored as Enum.
+func (s *Schema) RegisterKey(name string, t ValueType, values ...string) (Key, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if name == "" || strings.ContainsAny(name, " \t=:\"") {
+		return 0, fmt.Errorf("invalid key name %q", name)
+	}
+	if _, exists := s.byName[strings.ToUpper(name)]; exists {
+		return 0, fmt.Errorf("key %s already registered", name)
+	}
+	var goType reflect.Type
+	switch t {
+	case TYPE_INT:
+		goType = reflect.TypeOf(0)
+	case TYPE_STRING:
+		goType = reflect.TypeOf("")
+	case TYPE_ISBN:
+		goType = reflect.TypeOf(ISBN(""))
+	case TYPE_ENUM:
+		if len(values) == 0 {
+			return 0, fmt.Errorf("enum key %s needs at least one value", name)
+		}
+		goType = reflect.TypeOf(Enum(0))
+	default:
+		return 0, fmt.Errorf("invalid value type %d for key %s", int(t), name)
+	}
+	return s.register(strings.ToUpper(name), t, goType, append([]string(nil), values...)), nil
+}
+
+// AddValues extends the vocabulary of an enum key.
+func (s *Schema) AddValues(k Key, values ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return err
+	}
+	if spec.Type != TYPE_ENUM {
+		return fmt.Errorf("%s is not an enum key", spec.Name)
+	}
+	for _, v := range values {
+		if _, dup := lookupName(spec.Values, v); !dup {
+			spec.Values = append(spec.Values, v)
+		}
+	}
+	return nil
+}
+
+// DeclareMulti lets k hold an ordered list of values. A book that already
+// carries a single value reads as having a list of one.
+func (s *Schema) DeclareMulti(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return err
+	}
+	spec.Multi = true
+	return nil
+}
+
+// DeclareText makes the string key k free text, searched word by word by
+// Catalogue.Search. Books already in a catalogue are only indexed for it
+// when they next change, so declare text keys before loading books.
+func (s *Schema) DeclareText(k Key) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return err
+	}
+	if spec.Type != TYPE_STRING {
+		return fmt.Errorf("%s is not a string key", spec.Name)
+	}
+	spec.Text = true
+	return nil
+}
+
+// DeclareKind sets the keys a book of the named kind must and may carry,
+// adding the kind to the KIND vocabulary if it is new.
+func (s *Schema) DeclareKind(name string, required, optional []Key) (Kind, error) {
+	if err := s.AddValues(KEY_KIND, name); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, k := range append(append([]Key(nil), required...), optional...) {
+		if _, err := s.spec(k); err != nil {
+			return 0, err
+		}
+	}
+	i, _ := lookupName(s.keys[KEY_KIND].Values, name)
+	s.kinds[Kind(i)] = &KindSpec{
+		Required: append([]Key(nil), required...),
+		Optional: append([]Key(nil), optional...),
+	}
+	return Kind(i), nil
+}
+
+// Spec returns a copy of the description of k.
+func (s *Schema) Spec(k Key) (KeySpec, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return KeySpec{}, false
+	}
+	cp := *spec
+	cp.Values = append([]string(nil), spec.Values...)
+	return cp, true
+}
+
+// Keys returns every registered key in registration order.
+func (s *Schema) Keys() []Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := make([]Key, len(s.keys))
+	for i := range s.keys {
+		keys[i] = Key(i)
+	}
+	return keys
+}
+
+// Lookup finds a key by name, ignoring case.
+func (s *Schema) Lookup(name string) (Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	k, ok := s.byName[strings.ToUpper(name)]
+	return k, ok
+}
+
+func (s *Schema) multi(k Key) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	return err == nil && spec.Multi
+}
+
+func (s *Schema) text(k Key) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	return err == nil && spec.Text
+}
+
+func (s *Schema) spec(k Key) (*KeySpec, error) {
+	if k < 0 || int(k) >= len(s.keys) {
+		return nil, fmt.Errorf("unknown key %d", int(k))
+	}
+	return s.keys[k], nil
+}
+
+func (s *Schema) keyName(k Key) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if spec, err := s.spec(k); err == nil {
+		return spec.Name
+	}
+	return fmt.Sprintf("Key(%d)", int(k))
+}
+
+func (s *Schema) valueName(k Key, i int) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	if err != nil || i < 0 || i >= len(spec.Values) {
+		return fmt.Sprintf("%s(%d)", k, i)
+	}
+	return spec.Values[i]
+}
+
+// Check reports whether v has the type k holds and, for enum keys, is
+// part of the vocabulary, or for ISBN keys, has a valid check digit. A
+// multi-valued key also takes a non-empty slice of such values.
+func (s *Schema) Check(k Key, v interface{}) *AttrError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return &AttrError{Key: k, Value: v}
+	}
+	if rv := reflect.ValueOf(v); spec.Multi && rv.Kind() == reflect.Slice {
+		if rv.Len() == 0 {
+			return &AttrError{Key: k, Want: "non-empty list", Value: v}
+		}
+		for i := 0; i < rv.Len(); i++ {
+			if err := checkValue(spec, rv.Index(i).Interface()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return checkValue(spec, v)
+}
+
+func checkValue(spec *KeySpec, v interface{}) *AttrError {
+	k := spec.Key
+	if reflect.TypeOf(v) != spec.goType {
+		return &AttrError{Key: k, Want: spec.goType.Name(), Value: v}
+	}
+	switch spec.Type {
+	case TYPE_ENUM:
+		if i := reflect.ValueOf(v).Int(); i < 0 || i >= int64(len(spec.Values)) {
+			return &AttrError{Key: k, Want: spec.goType.Name(), Value: v}
+		}
+	case TYPE_ISBN:
+		if !v.(ISBN).valid() {
+			return &AttrError{Key: k, Want: "valid ISBN", Value: v}
+		}
+	}
+	return nil
+}
+
+// Parse converts the text form of a value to the type k holds. Enum names
+// are matched ignoring case.
+func (s *Schema) Parse(k Key, text string) (interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec, err := s.spec(k)
+	if err != nil {
+		return nil, err
+	}
+	switch spec.Type {
+	case TYPE_INT:
+		n, err := strconv.Atoi(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s %q", spec.Name, text)
+		}
+		return n, nil
+	case TYPE_STRING:
+		return text, nil
+	case TYPE_ISBN:
+		return ParseISBN(text)
+	}
+	i, ok := lookupName(spec.Values, text)
+	if !ok {
+		return nil, fmt.Errorf("unknown %s %q (want one of %s)", spec.Name, text, strings.Join(spec.Values, ", "))
+	}
+	return reflect.ValueOf(i).Convert(spec.goType).Interface(), nil
+}
+
+// Format returns the text form of v that Parse reads back.
+func (s *Schema) Format(k Key, v interface{}) string {
+	switch val := v.(type) {
+	case string:
+		return val
+	case int:
+		return strconv.Itoa(val)
+	}
+	if rv := reflect.ValueOf(v); rv.CanInt() {
+		return s.valueName(k, int(rv.Int()))
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+// CheckBook reports the keys a book is missing or may not carry for its Kind.
+func (s *Schema) CheckBook(attrs *Attributes) error {
+	kind, ok := attrs.attrMap[KEY_KIND].(Kind)
+	if !ok {
+		return &KindError{Missing: []Key{KEY_KIND}}
+	}
+	s.mu.RLock()
+	spec := s.kinds[kind]
+	s.mu.RUnlock()
+	if spec == nil {
+		return nil
+	}
+	e := &KindError{Kind: kind}
+	allowed := map[Key]bool{KEY_KIND: true}
+	for _, k := range spec.Required {
+		allowed[k] = true
+		if _, has := attrs.attrMap[k]; !has {
+			e.Missing = append(e.Missing, k)
+		}
+	}
+	for _, k := range spec.Optional {
+		allowed[k] = true
+	}
+	for _, k := range attrs.sortedKeys() {
+		if !allowed[k] {
+			e.Disallowed = append(e.Disallowed, k)
+		}
+	}
+	if len(e.Missing) > 0 || len(e.Disallowed) > 0 {
+		return e
+	}
+	return nil
+}
+
+// allows reports whether a book of the given Kind may carry k.
+func (s *Schema) allows(kind Kind, k Key) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	spec := s.kinds[kind]
+	if spec == nil || k == KEY_KIND {
+		return true
+	}
+	for _, keys := range [][]Key{spec.Required, spec.Optional} {
+		for _, key := range keys {
+			if key == k {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// KindError reports the keys a book is missing or may not carry for its Kind.
+type KindError struct {
+	Kind       Kind
+	Missing    []Key
+	Disallowed []Key
+}
+
+func (e *KindError) Error() string {
+	if len(e.Missing) == 1 && e.Missing[0] == KEY_KIND {
+		return "book has no KIND"
+	}
+	var msgs []string
+	if len(e.Missing) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s missing %s", e.Kind, joinKeys(e.Missing)))
+	}
+	if len(e.Disallowed) > 0 {
+		msgs = append(msgs, fmt.Sprintf("%s may not carry %s", e.Kind, joinKeys(e.Disallowed)))
+	}
+	return strings.Join(msgs, "; ")
+}
+
+func joinKeys(keys []Key) string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.String()
+	}
+	return strings.Join(names, ", ")
+}
+
+// schemaFile is the JSON layout read by LoadSchema:
+//
+//	{"keys":  [{"name": "FORMAT", "type": "enum", "values": ["hardcover", "paperback"]},
+//	           {"name": "EDITOR", "type": "string", "multi": true},
+//	           {"name": "BLURB", "type": "string", "text": true},
+//	           {"name": "GENRE", "values": ["poetry"]}],
+//	 "kinds": [{"name": "poetry", "required": ["TITLE", "LAST"], "optional": ["FORMAT"]}]}
+//
+// A key that is already registered only has its vocabulary extended, and
+// is made multi-valued or free text if asked.
+type schemaFile struct {
+	Keys []struct {
+		Name   string   `json:"name"`
+		Type   string   `json:"type"`
+		Values []string `json:"values"`
+		Multi  bool     `json:"multi"`
+		Text   bool     `json:"text"`
+	} `json:"keys"`
+	Kinds []struct {
+		Name     string   `json:"name"`
+		Required []string `json:"required"`
+		Optional []string `json:"optional"`
+	} `json:"kinds"`
+}
+
+// LoadSchema registers the keys and kinds described in a schema file.
+func (s *Schema) LoadSchema(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var file schemaFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	for _, ks := range file.Keys {
+		k, exists := s.Lookup(ks.Name)
+		if exists {
+			if len(ks.Values) > 0 {
+				err = s.AddValues(k, ks.Values...)
+			}
+		} else if i, ok := lookupName(valueTypeNames[:], ks.Type); ok {
+			k, err = s.RegisterKey(ks.Name, ValueType(i), ks.Values...)
+		} else {
+			err = fmt.Errorf("key %s: unknown type %q", ks.Name, ks.Type)
+		}
+		if err == nil && ks.Multi {
+			err = s.DeclareMulti(k)
+		}
+		if err == nil && ks.Text {
+			err = s.DeclareText(k)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	for _, kd := range file.Kinds {
+		var keys [2][]Key
+		for i, names := range [2][]string{kd.Required, kd.Optional} {
+			for _, name := range names {
+				k, ok := s.Lookup(name)
+				if !ok {
+					return fmt.Errorf("%s: kind %s: unknown key %q", path, kd.Name, name)
+				}
+				keys[i] = append(keys[i], k)
+			}
+		}
+		if _, err := s.DeclareKind(kd.Name, keys[0], keys[1]); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// lookupName returns the position of name in names, ignoring case.
+func lookupName(names []string, name string) (int, bool) {
+	for i, n := range names {
+		if strings.EqualFold(n, name) {
+			return i, true
+		}
+	}
+	return 0, false
+}
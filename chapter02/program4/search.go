@@ -0,0 +1,501 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// TextIndex is an inverted index of the words in the free-text keys of
+// every book, for ranking keyword searches with BM25. The words of all
+// such keys of a book count as one document.
+type TextIndex struct {
+	postings map[string]map[int]int // term -> book ID -> occurrences
+	lengths  map[int]int            // book ID -> terms indexed
+	total    int                    // sum of lengths
+}
+
+func (tx *TextIndex) add(f Folding, id int, attrs *Attributes) {
+	terms := documentTerms(f, attrs)
+	if len(terms) == 0 {
+		return
+	}
+	if tx.postings == nil {
+		tx.postings = map[string]map[int]int{}
+		tx.lengths = map[int]int{}
+	}
+	for _, term := range terms {
+		if tx.postings[term] == nil {
+			tx.postings[term] = map[int]int{}
+		}
+		tx.postings[term][id]++
+	}
+	tx.lengths[id] = len(terms)
+	tx.total += len(terms)
+}
+
+func (tx *TextIndex) remove(f Folding, id int, attrs *Attributes) {
+	for _, term := range documentTerms(f, attrs) {
+		delete(tx.postings[term], id)
+		if len(tx.postings[term]) == 0 {
+			delete(tx.postings, term)
+		}
+	}
+	tx.total -= tx.lengths[id]
+	delete(tx.lengths, id)
+}
+
+// documentTerms analyzes the values of every free-text key of a book.
+func documentTerms(f Folding, attrs *Attributes) []string {
+	var terms []string
+	for _, k := range attrs.sortedKeys() {
+		if !DefaultSchema.text(k) {
+			continue
+		}
+		for _, v := range attrs.values(k) {
+			for _, w := range f.analyze(v.(string)) {
+				terms = append(terms, w.term)
+			}
+		}
+	}
+	return terms
+}
+
+// BM25 parameters: k1 limits how much repeating a word raises the score,
+// b how much long documents are penalized.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// SearchHit is a book found by Search, with its BM25 score and the
+// best-matching text with the matched words in [brackets].
+type SearchHit struct {
+	Book    *Book
+	Score   float64
+	Snippet string
+}
+
+func (h SearchHit) String() string {
+	return fmt.Sprintf("%.3f %s", h.Score, h.Snippet)
+}
+
+// Search ranks the books whose free-text keys contain words of text by
+// BM25 relevance, best first. Words are matched by stem, ignoring case and
+// stop words, so "space odysseys" finds "2001: A Space Odyssey". A
+// non-nil filter restricts the books searched; limit 0 returns every hit.
+func (c *Catalogue) Search(text string, filter Query, limit int) []SearchHit {
+	var terms []string
+	seen := map[string]bool{}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for _, w := range c.index.folding.analyze(text) {
+		if !seen[w.term] {
+			seen[w.term] = true
+			terms = append(terms, w.term)
+		}
+	}
+	tx := &c.index.text
+	if len(terms) == 0 || len(tx.lengths) == 0 {
+		return nil
+	}
+	var allowed map[int]bool
+	if filter != nil {
+		allowed = map[int]bool{}
+		for _, book := range c.find(filter) {
+			allowed[book.ID] = true
+		}
+	}
+
+	n := float64(len(tx.lengths))
+	avgLen := float64(tx.total) / n
+	scores := map[int]float64{}
+	for _, term := range terms {
+		docs := tx.postings[term]
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range docs {
+			if allowed != nil && !allowed[id] {
+				continue
+			}
+			norm := 1 - bm25B + bm25B*float64(tx.lengths[id])/avgLen
+			scores[id] += idf * float64(tf) * (bm25K1 + 1) / (float64(tf) + bm25K1*norm)
+		}
+	}
+
+	hits := make([]SearchHit, 0, len(scores))
+	for id, score := range scores {
+		hits = append(hits, SearchHit{Book: c.byID[id], Score: score})
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Score != hits[j].Score {
+			return hits[i].Score > hits[j].Score
+		}
+		return hits[i].Book.ID < hits[j].Book.ID
+	})
+	if limit > 0 && len(hits) > limit {
+		hits = hits[:limit]
+	}
+	for i := range hits {
+		hits[i].Snippet = snippet(c.index.folding, hits[i].Book.Attrs, seen)
+	}
+	return hits
+}
+
+// snippetLen is the most runes of text a snippet shows around its matches.
+const snippetLen = 80
+
+// snippet picks the free-text value with the most matched words and marks
+// them. A long value is cut to snippetLen runes starting a little before
+// the first match.
+func snippet(f Folding, attrs *Attributes, terms map[string]bool) string {
+	best, bestWords, bestCount := "", []textWord(nil), -1
+	for _, k := range attrs.sortedKeys() {
+		if !DefaultSchema.text(k) {
+			continue
+		}
+		for _, v := range attrs.values(k) {
+			var matched []textWord
+			for _, w := range f.analyze(v.(string)) {
+				if terms[w.term] {
+					matched = append(matched, w)
+				}
+			}
+			if len(matched) > bestCount {
+				best, bestWords, bestCount = v.(string), matched, len(matched)
+			}
+		}
+	}
+
+	from, to, prefix, suffix := 0, len(best), "", ""
+	if utf8.RuneCountInString(best) > snippetLen {
+		if len(bestWords) > 0 {
+			from = wordStart(best, bestWords[0].start, 3)
+		}
+		to = from
+		for n := 0; n < snippetLen && to < len(best); n++ {
+			_, size := utf8.DecodeRuneInString(best[to:])
+			to += size
+		}
+		if from > 0 {
+			prefix = "…"
+		}
+		if to < len(best) {
+			suffix = "…"
+		}
+	}
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	pos := from
+	for _, w := range bestWords {
+		if w.start < from || w.end > to {
+			continue
+		}
+		sb.WriteString(best[pos:w.start])
+		sb.WriteString("[" + best[w.start:w.end] + "]")
+		pos = w.end
+	}
+	sb.WriteString(best[pos:to])
+	sb.WriteString(suffix)
+	return sb.String()
+}
+
+// wordStart steps back over up to n words before byte offset i.
+func wordStart(s string, i, n int) int {
+	words := Folding{}.tokenize(s[:i])
+	if len(words) <= n {
+		return 0
+	}
+	return words[len(words)-n].start
+}
+
+// textWord is one word of a text: its index term and where it lies.
+type textWord struct {
+	term       string
+	start, end int // byte offsets
+}
+
+// tokenize splits text into words: runs of letters and digits, with
+// apostrophes inside a word kept. A possessive 's is dropped from the
+// term. Terms are lower case and folded by f.
+func (f Folding) tokenize(text string) []textWord {
+	var words []textWord
+	for i := 0; i < len(text); {
+		r, size := utf8.DecodeRuneInString(text[i:])
+		if !isWordRune(r) {
+			i += size
+			continue
+		}
+		start := i
+		for i < len(text) {
+			r, size := utf8.DecodeRuneInString(text[i:])
+			if isWordRune(r) {
+				i += size
+				continue
+			}
+			if (r == '\'' || r == '’') && i+size < len(text) {
+				if next, _ := utf8.DecodeRuneInString(text[i+size:]); isWordRune(next) {
+					i += size
+					continue
+				}
+			}
+			break
+		}
+		term := strings.ToLower(f.Fold(text[start:i]))
+		term = strings.TrimSuffix(strings.TrimSuffix(term, "'s"), "’s")
+		words = append(words, textWord{term: term, start: start, end: i})
+	}
+	return words
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+}
+
+// analyze tokenizes text, drops stop words and stems the rest.
+func (f Folding) analyze(text string) []textWord {
+	words := f.tokenize(text)
+	out := words[:0]
+	for _, w := range words {
+		if stopWords[w.term] {
+			continue
+		}
+		w.term = stem(w.term)
+		out = append(out, w)
+	}
+	return out
+}
+
+// stopWords are English words too common to help rank results.
+var stopWords = map[string]bool{}
+
+func init() {
+	for _, w := range strings.Fields(`a about above after again against all am an and any are as at
+		be because been before being below between both but by can did do does doing down during
+		each few for from further had has have having he her here hers herself him himself his how
+		i if in into is it its itself just me more most my myself no nor not now of off on once only
+		or other our ours ourselves out over own same she should so some such than that the their
+		theirs them themselves then there these they this those through to too under until up very
+		was we were what when where which while who whom why will with you your yours yourself`) {
+		stopWords[w] = true
+	}
+}
+
+// stem reduces an English word to its stem with the Porter algorithm, so
+// "cooking", "cooks" and "cooked" all become "cook". Words of other than
+// ASCII letters are left as they are.
+func stem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	p := &porter{b: []byte(word), k: len(word) - 1}
+	p.step1ab()
+	p.step1c()
+	p.step2()
+	p.step3()
+	p.step4()
+	p.step5()
+	return string(p.b[:p.k+1])
+}
+
+// porter holds a word being stemmed: b[:k+1] is the word so far and, once
+// a suffix has been found by ends, b[:j+1] is what precedes it.
+type porter struct {
+	b    []byte
+	k, j int
+}
+
+// cons reports whether b[i] is a consonant; y is one unless it follows a
+// consonant.
+func (p *porter) cons(i int) bool {
+	switch p.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !p.cons(i-1)
+	}
+	return true
+}
+
+// m counts the vowel-consonant sequences in b[:j+1]: with C a run of
+// consonants and V of vowels, the stem has the form [C](VC){m}[V].
+func (p *porter) m() int {
+	n, i := 0, 0
+	for ; i <= p.j && p.cons(i); i++ {
+	}
+	for i <= p.j {
+		for ; i <= p.j && !p.cons(i); i++ {
+		}
+		if i > p.j {
+			break
+		}
+		n++
+		for ; i <= p.j && p.cons(i); i++ {
+		}
+	}
+	return n
+}
+
+func (p *porter) vowelInStem() bool {
+	for i := 0; i <= p.j; i++ {
+		if !p.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doublec reports whether b[i-1:i+1] is a double consonant.
+func (p *porter) doublec(i int) bool {
+	return i >= 1 && p.b[i] == p.b[i-1] && p.cons(i)
+}
+
+// cvc reports whether b[i-2:i+1] is consonant-vowel-consonant with the
+// last not w, x or y, as in hop or cav(e) but not snow or box.
+func (p *porter) cvc(i int) bool {
+	if i < 2 || !p.cons(i) || p.cons(i-1) || !p.cons(i-2) {
+		return false
+	}
+	ch := p.b[i]
+	return ch != 'w' && ch != 'x' && ch != 'y'
+}
+
+// ends reports whether the word ends with s, and if so sets j before it.
+func (p *porter) ends(s string) bool {
+	if len(s) > p.k+1 || string(p.b[p.k+1-len(s):p.k+1]) != s {
+		return false
+	}
+	p.j = p.k - len(s)
+	return true
+}
+
+// setto replaces the suffix after j with s.
+func (p *porter) setto(s string) {
+	p.b = append(p.b[:p.j+1], s...)
+	p.k = p.j + len(s)
+}
+
+// r replaces the suffix if the stem before it has a measure above zero.
+func (p *porter) r(s string) {
+	if p.m() > 0 {
+		p.setto(s)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing.
+func (p *porter) step1ab() {
+	if p.b[p.k] == 's' {
+		switch {
+		case p.ends("sses"):
+			p.k -= 2
+		case p.ends("ies"):
+			p.setto("i")
+		case p.b[p.k-1] != 's':
+			p.k--
+		}
+	}
+	if p.ends("eed") {
+		if p.m() > 0 {
+			p.k--
+		}
+		return
+	}
+	if (p.ends("ed") || p.ends("ing")) && p.vowelInStem() {
+		p.k = p.j
+		switch {
+		case p.ends("at"):
+			p.setto("ate")
+		case p.ends("bl"):
+			p.setto("ble")
+		case p.ends("iz"):
+			p.setto("ize")
+		case p.doublec(p.k):
+			if ch := p.b[p.k]; ch != 'l' && ch != 's' && ch != 'z' {
+				p.k--
+			}
+		default:
+			if p.m() == 1 && p.cvc(p.k) {
+				p.setto("e")
+			}
+		}
+	}
+}
+
+// step1c turns a final y into i when there is another vowel in the stem.
+func (p *porter) step1c() {
+	if p.ends("y") && p.vowelInStem() {
+		p.b[p.k] = 'i'
+	}
+}
+
+// replaceFirst applies r to the first suffix of rules the word ends with.
+func (p *porter) replaceFirst(rules [][2]string) {
+	for _, rule := range rules {
+		if p.ends(rule[0]) {
+			p.r(rule[1])
+			return
+		}
+	}
+}
+
+var porterStep2 = [][2]string{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"bli", "ble"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+	{"logi", "log"},
+}
+
+var porterStep3 = [][2]string{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var porterStep4 = []string{
+	"al", "ance", "ence", "er", "ic", "able", "ible", "ant", "ement", "ment",
+	"ent", "ion", "ou", "ism", "ate", "iti", "ous", "ive", "ize",
+}
+
+// step2 maps double suffixes to single ones: -ization to -ize and so on.
+func (p *porter) step2() { p.replaceFirst(porterStep2) }
+
+// step3 deals with -ic-, -full, -ness and the like.
+func (p *porter) step3() { p.replaceFirst(porterStep3) }
+
+// step4 removes -ant, -ence and the like from a stem of measure two or more.
+func (p *porter) step4() {
+	for _, suffix := range porterStep4 {
+		if !p.ends(suffix) {
+			continue
+		}
+		if suffix == "ion" && (p.j < 0 || (p.b[p.j] != 's' && p.b[p.j] != 't')) {
+			continue
+		}
+		if p.m() > 1 {
+			p.k = p.j
+		}
+		return
+	}
+}
+
+// step5 removes a final -e and turns -ll into -l on longer stems.
+func (p *porter) step5() {
+	p.j = p.k
+	if p.b[p.k] == 'e' {
+		if a := p.m(); a > 1 || a == 1 && !p.cvc(p.k-1) {
+			p.k--
+		}
+	}
+	if p.b[p.k] == 'l' && p.doublec(p.k) && p.m() > 1 {
+		p.k--
+	}
+}
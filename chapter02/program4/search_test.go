@@ -0,0 +1,159 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestEditDistance(t *testing.T) {
+	for _, test := range []struct {
+		a, b  string
+		limit int
+		want  int
+	}{
+		{"", "", 2, 0},
+		{"abc", "", 3, 3},
+		{"", "ab", 2, 2},
+		{"kitten", "sitting", 3, 3},
+		{"tolkien", "tolkein", 2, 1},
+		{"ca", "abc", 3, 2},
+		{"abcdef", "badcfe", 3, 3},
+		{"atwood", "atwood", 0, 0},
+		{"éclair", "eclair", 1, 1},
+		{"pratchett", "gaiman", 2, 3},
+		{"pratchett", "pratchet", 0, 1},
+		{"abc", "abcdef", 2, 3},
+	} {
+		if got := editDistance(test.a, test.b, test.limit); got != test.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", test.a, test.b, test.limit, got, test.want)
+		}
+		if got := editDistance(test.b, test.a, test.limit); got != test.want {
+			t.Errorf("editDistance(%q, %q, %d) = %d, want %d", test.b, test.a, test.limit, got, test.want)
+		}
+	}
+}
+
+// sampleCatalogue holds the sample books.
+func sampleCatalogue(t *testing.T) *Catalogue {
+	t.Helper()
+	c := &Catalogue{}
+	if err := fill(c); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestFindFuzzy(t *testing.T) {
+	c := sampleCatalogue(t)
+	for _, test := range []struct {
+		text  string
+		dist  int
+		ids   []int
+		value string
+	}{
+		{"kng", 1, []int{9, 10, 25}, "King"},
+		{"KINQ", 1, []int{9, 10, 25}, "King"},
+		{"shelly", 1, []int{11}, "Shelley"},
+		{"gaimen", 1, []int{14}, "Gaiman"},
+		{"pratchet", 0, nil, ""},
+		{"zolla", 1, []int{5}, "Zola"},
+		{"xyz", 2, nil, ""},
+	} {
+		matches, err := c.FindFuzzy(KEY_LAST, test.text, test.dist)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int
+		for _, m := range matches {
+			ids = append(ids, m.Book.ID)
+			if m.Value != test.value {
+				t.Errorf("FindFuzzy(%q): #%d matched %q, want %q", test.text, m.Book.ID, m.Value, test.value)
+			}
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("FindFuzzy(%q, %d) found %v, want %v", test.text, test.dist, ids, test.ids)
+		}
+	}
+	if _, err := c.FindFuzzy(KEY_LAST, "king", -1); err == nil {
+		t.Error("FindFuzzy with a negative distance succeeded")
+	}
+	if _, err := c.FindFuzzy(KEY_YEAR, "1960", 1); err == nil {
+		t.Error("FindFuzzy on an int key succeeded")
+	}
+}
+
+func TestDidYouMean(t *testing.T) {
+	c := sampleCatalogue(t)
+	for _, test := range []struct {
+		query, want string
+	}{
+		{"last:shelly", "LAST = 'Shelley'"},
+		{"last:christy kind:fiction", "LAST = 'Christie' and KIND = fiction"},
+		{"last:kinq genre:detective", ""},
+		{"last:king", ""},
+		{"last:qqqqqq", ""},
+	} {
+		q, err := ParseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if s, ok := c.DidYouMean(q); ok {
+			got = s.String()
+		}
+		if got != test.want {
+			t.Errorf("DidYouMean(%s) = %q, want %q", test.query, got, test.want)
+		}
+	}
+}
+
+func TestSearchRanking(t *testing.T) {
+	c := &Catalogue{}
+	for _, title := range []string{"Space Odyssey", "Space", "Gardens", "The Space Between the Stars and the Moons"} {
+		if _, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: title, KEY_LAST: "X", KEY_GENRE: SCIFI})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Four documents of 2, 1, 1 and 3 terms once stop words are dropped.
+	n, avgLen := 4.0, 7.0/4
+	bm25 := func(df, tf, length float64) float64 {
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		return idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*length/avgLen))
+	}
+	for _, test := range []struct {
+		text    string
+		ids     []int
+		scores  []float64
+		snippet string
+	}{
+		{"odysseys", []int{1}, []float64{bm25(1, 1, 2)}, "Space [Odyssey]"},
+		{"space", []int{2, 1, 4}, []float64{bm25(3, 1, 1), bm25(3, 1, 2), bm25(3, 1, 3)}, "[Space]"},
+		{"space odyssey", []int{1, 2, 4}, []float64{bm25(3, 1, 2) + bm25(1, 1, 2), bm25(3, 1, 1), bm25(3, 1, 3)}, "[Space] [Odyssey]"},
+		{"garden", []int{3}, []float64{bm25(1, 1, 1)}, "[Gardens]"},
+		{"the and", nil, nil, ""},
+	} {
+		hits := c.Search(test.text, nil, 0)
+		var ids []int
+		for i, hit := range hits {
+			ids = append(ids, hit.Book.ID)
+			if i < len(test.scores) && math.Abs(hit.Score-test.scores[i]) > 1e-9 {
+				t.Errorf("Search(%q): #%d scored %f, want %f", test.text, hit.Book.ID, hit.Score, test.scores[i])
+			}
+		}
+		if !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Search(%q) found %v, want %v", test.text, ids, test.ids)
+			continue
+		}
+		if len(hits) > 0 && hits[0].Snippet != test.snippet {
+			t.Errorf("Search(%q): snippet %q, want %q", test.text, hits[0].Snippet, test.snippet)
+		}
+	}
+
+	if hits := c.Search("space", nil, 2); len(hits) != 2 {
+		t.Errorf("Search with limit 2 found %d", len(hits))
+	}
+	if hits := c.Search("space", MustWhere(KEY_TITLE, OP_PREFIX, "the"), 0); len(hits) != 1 || hits[0].Book.ID != 4 {
+		t.Errorf("Search with a filter found %v", hits)
+	}
+}
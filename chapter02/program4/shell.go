@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Shell is an interactive command line over a Catalogue. Books are
+// shown and named by their ID.
+type Shell struct {
+	c     *Catalogue
+	tty   *os.File // the input, if it is a file that may be a terminal
+	in    *bufio.Reader
+	out   io.Writer
+	raw   bool      // the terminal hands us every key, so Tab can complete
+	order []SortKey // set by the sort command; nil lists books by ID
+}
+
+var shellCommands = []string{"add", "count", "export", "facets", "find", "help", "import", "isbn", "list", "quit", "remove", "report", "search", "sort", "update"}
+
+const shellHelp = `Commands:
+  add FIELD=VALUE ...           add a book, e.g. add kind=fiction title="Dune" last=Herbert genre=scifi
+  find QUERY                    list matching books, e.g. find kind:fiction year>=1980 -last:king
+  count [QUERY]                 count all or matching books
+  facets FIELD,... [QUERY]      count the values of each field among all or matching
+                                books, e.g. facets genre,year kind:fiction
+  list                          list every book
+  report [-csv|-json] FIELD [QUERY]
+                                tabulate book counts and years by FIELD, e.g. report genre
+  search WORDS                  rank books by how well their titles match WORDS
+  isbn NUMBER                   show the ISBN-13 and ISBN-10 forms of NUMBER and the
+                                book carrying it
+  sort [FIELD,-FIELD ...]       order find and list by these fields (- for descending),
+                                or by ID again without fields
+  update ID FIELD=VALUE ... -FIELD
+                                change or (with -) remove fields of book ID
+  remove ID                     remove book ID
+  export [FILE]                 write the catalogue as JSON to FILE or the screen,
+                                or as CSV, BibTeX, RIS or Dublin Core XML to a FILE
+                                ending in .csv, .bib, .ris or .xml
+  import FILE [FIELD=VALUE ...] add the books in a CSV, MARC (.mrc, or .xml for MARCXML),
+                                BibTeX (.bib) or RIS (.ris) file, reporting bad records;
+                                the fields fill in what the records leave out
+  help                          show this text
+  quit                          leave the shell
+Tab completes commands, field names and enum values.
+`
+
+func NewShell(c *Catalogue, in io.Reader, out io.Writer) *Shell {
+	tty, _ := in.(*os.File)
+	return &Shell{c: c, tty: tty, in: bufio.NewReader(in), out: out}
+}
+
+// Run reads and executes commands until quit or end of input. When the
+// input is a terminal it is switched to raw mode for the duration;
+// otherwise lines are read as they come.
+func (sh *Shell) Run() error {
+	if sh.tty != nil {
+		if out, restore, err := rawTerminal(sh.tty, sh.out); err == nil {
+			sh.raw, sh.out = true, out
+			defer restore()
+		}
+	}
+	fmt.Fprintf(sh.out, "%d books. Type help for commands.\n", sh.c.Len())
+	for {
+		line, err := sh.readLine("catalogue> ")
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if strings.TrimSpace(line) == "quit" {
+			return nil
+		}
+		if err := sh.Exec(line); err != nil {
+			fmt.Fprintf(sh.out, "error: %v\n", err)
+		}
+	}
+}
+
+// Exec runs one command line.
+func (sh *Shell) Exec(line string) error {
+	cmd, args, _ := strings.Cut(strings.TrimSpace(line), " ")
+	args = strings.TrimSpace(args)
+	switch cmd {
+	case "":
+		return nil
+	case "help":
+		fmt.Fprint(sh.out, shellHelp)
+	case "add":
+		pairs, err := parseFields(args, false)
+		if err != nil {
+			return err
+		}
+		attrs, err := NewAttributes(pairs)
+		if err != nil {
+			return err
+		}
+		id, err := sh.c.Add(attrs)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "added #%d\n", id)
+	case "find", "count":
+		q, err := ParseQuery(args)
+		if err != nil {
+			return err
+		}
+		if cmd == "count" {
+			fmt.Fprintln(sh.out, len(sh.c.Find(q)))
+			return nil
+		}
+		page, err := sh.c.FindPage(q, FindOptions{Sort: sh.order})
+		if err != nil {
+			return err
+		}
+		sh.print(page.Books)
+		if page.Total == 0 {
+			if s, ok := sh.c.DidYouMean(q); ok {
+				fmt.Fprintf(sh.out, "did you mean %s?\n", s)
+			}
+		}
+	case "facets":
+		names, text, _ := strings.Cut(args, " ")
+		var keys []Key
+		for _, name := range strings.Split(names, ",") {
+			k, ok := DefaultSchema.Lookup(name)
+			if !ok {
+				return fmt.Errorf("unknown field %q", name)
+			}
+			keys = append(keys, k)
+		}
+		q, err := ParseQuery(text)
+		if err != nil {
+			return err
+		}
+		facets, err := sh.c.Facets(q, keys...)
+		if err != nil {
+			return err
+		}
+		for _, f := range facets {
+			fmt.Fprintln(sh.out, f)
+		}
+	case "report":
+		format := "text"
+		if opt, rest, _ := strings.Cut(args, " "); opt == "-csv" || opt == "-json" {
+			format, args = opt[1:], strings.TrimSpace(rest)
+		}
+		name, text, _ := strings.Cut(args, " ")
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			return fmt.Errorf("unknown field %q", name)
+		}
+		q, err := ParseQuery(text)
+		if err != nil {
+			return err
+		}
+		report, err := sh.c.GroupReport(k, q)
+		if err != nil {
+			return err
+		}
+		return report.Write(sh.out, format)
+	case "search":
+		hits := sh.c.Search(args, nil, 0)
+		for _, hit := range hits {
+			fmt.Fprintf(sh.out, "#%d %.3f %s\n", hit.Book.ID, hit.Score, hit.Snippet)
+		}
+		fmt.Fprintf(sh.out, "(%d books)\n", len(hits))
+	case "isbn":
+		isbn, err := ParseISBN(args)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "ISBN-13 %s", isbn)
+		if isbn10, ok := isbn.ISBN10(); ok {
+			fmt.Fprintf(sh.out, ", ISBN-10 %s", isbn10)
+		}
+		fmt.Fprintln(sh.out)
+		if book, ok := sh.c.ByISBN(isbn); ok {
+			sh.print([]*Book{book})
+		}
+	case "list":
+		page, err := sh.c.FindPage(And{}, FindOptions{Sort: sh.order})
+		if err != nil {
+			return err
+		}
+		sh.print(page.Books)
+	case "sort":
+		if args == "" {
+			sh.order = nil
+			return nil
+		}
+		order, err := ParseSort(args)
+		if err != nil {
+			return err
+		}
+		sh.order = order
+	case "update":
+		num, fields, _ := strings.Cut(args, " ")
+		id, err := bookID(num)
+		if err != nil {
+			return err
+		}
+		patch, err := parseFields(fields, true)
+		if err != nil {
+			return err
+		}
+		book, err := sh.c.Update(id, patch)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "#%d %s\n", id, book)
+	case "remove":
+		id, err := bookID(args)
+		if err != nil {
+			return err
+		}
+		if err := sh.c.Remove(id); err != nil {
+			return fmt.Errorf("#%d: %v", id, err)
+		}
+		fmt.Fprintf(sh.out, "removed #%d\n", id)
+	case "import":
+		name, fields, _ := strings.Cut(args, " ")
+		defaults, err := parseFields(fields, false)
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		var report fmt.Stringer
+		switch ext := strings.ToLower(filepath.Ext(name)); ext {
+		case ".mrc", ".marc", ".xml":
+			read := ReadMARC
+			if ext == ".xml" {
+				read = ReadMARCXML
+			}
+			var records []*MARCRecord
+			if records, err = read(f); err != nil {
+				return err
+			}
+			report, err = sh.c.ImportMARC(records, &MARCMapping{Rules: DefaultMARCMapping.Rules, Defaults: defaults})
+		case ".bib":
+			report, err = sh.c.ImportBibTeX(f, defaults)
+		case ".ris":
+			report, err = sh.c.ImportRIS(f, defaults)
+		default:
+			report, err = sh.c.ImportCSV(f)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(sh.out, report)
+	case "export":
+		exporters := map[string]func(io.Writer, Query) error{
+			".csv": sh.c.ExportCSV, ".bib": sh.c.ExportBibTeX, ".ris": sh.c.ExportRIS,
+			".xml": sh.c.ExportDublinCore,
+		}
+		if export, ok := exporters[strings.ToLower(filepath.Ext(args))]; ok {
+			var buf bytes.Buffer
+			if err := export(&buf, nil); err != nil {
+				return err
+			}
+			if err := os.WriteFile(args, buf.Bytes(), 0o644); err != nil {
+				return err
+			}
+			fmt.Fprintf(sh.out, "wrote %s\n", args)
+			return nil
+		}
+		data, err := json.MarshalIndent(sh.c, "", "  ")
+		if err != nil {
+			return err
+		}
+		if args == "" {
+			fmt.Fprintf(sh.out, "%s\n", data)
+			return nil
+		}
+		if err := os.WriteFile(args, append(data, '\n'), 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(sh.out, "wrote %s\n", args)
+	default:
+		return fmt.Errorf("unknown command %q (try help)", cmd)
+	}
+	return nil
+}
+
+func bookID(num string) (int, error) {
+	id, err := strconv.Atoi(strings.TrimPrefix(num, "#"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid book number %q", num)
+	}
+	return id, nil
+}
+
+func (sh *Shell) print(books []*Book) {
+	for _, book := range books {
+		fmt.Fprintf(sh.out, "#%d %s\n", book.ID, book)
+	}
+	fmt.Fprintf(sh.out, "(%d books)\n", len(books))
+}
+
+// parseFields reads the FIELD=VALUE pairs given to add and update. A
+// multi-valued field takes a list, as in last=Pratchett,Gaiman. With
+// unset, -FIELD maps the field to nil.
+func parseFields(text string, unset bool) (map[Key]interface{}, error) {
+	toks, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &queryParser{input: text, toks: toks}
+	pairs := map[Key]interface{}{}
+	for p.peek().kind != tokEOF {
+		remove := unset && p.peek().kind == tokNot
+		if remove {
+			p.next()
+		}
+		field := p.next()
+		if field.kind != tokWord {
+			return nil, p.errorf(field, "expected a field name, found %q", field.text)
+		}
+		k, ok := DefaultSchema.Lookup(field.text)
+		if !ok {
+			return nil, p.errorf(field, "unknown field %q", field.text)
+		}
+		if remove {
+			pairs[k] = nil
+			continue
+		}
+		if op := p.next(); op.text != "=" && op.text != ":" {
+			return nil, p.errorf(op, "expected = after %s, found %q", k, op.text)
+		}
+		v, err := p.parseValue(k)
+		if err != nil {
+			return nil, err
+		}
+		if DefaultSchema.multi(k) {
+			list := []interface{}{v}
+			for p.peek().kind == tokComma {
+				p.next()
+				if v, err = p.parseValue(k); err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			v = list
+		}
+		pairs[k] = v
+	}
+	return pairs, nil
+}
+
+// complete returns where the word being typed at the end of line starts
+// and the words it could become.
+func (sh *Shell) complete(line string) (int, []string) {
+	start := strings.LastIndexAny(line, " (") + 1
+	word := line[start:]
+	var choices []string
+	if start == 0 {
+		choices = shellCommands
+	} else {
+		cmd, _, _ := strings.Cut(line, " ")
+		sep := ":"
+		switch cmd {
+		case "add", "update":
+			sep = "="
+		case "sort", "facets":
+			if cmd == "facets" && strings.Count(line[:start], " ") > 1 {
+				break // the query after the fields
+			}
+			sep = ""
+			i := strings.LastIndex(word, ",") + 1
+			start, word = start+i, word[i:]
+		}
+		lead := strings.TrimLeft(word, "-")
+		start += len(word) - len(lead)
+		word = lead
+		if i := strings.IndexAny(word, ":=<>~"); i >= 0 {
+			j := i + 1
+			if j < len(word) && word[j] == '=' {
+				j++
+			}
+			k, ok := DefaultSchema.Lookup(word[:i])
+			spec, _ := DefaultSchema.Spec(k)
+			if !ok || spec.Type != TYPE_ENUM {
+				return start, nil
+			}
+			for _, v := range spec.Values {
+				choices = append(choices, word[:j]+v)
+			}
+		} else {
+			for _, k := range DefaultSchema.Keys() {
+				choices = append(choices, strings.ToLower(k.String())+sep)
+			}
+		}
+	}
+	var matches []string
+	for _, choice := range choices {
+		if len(choice) >= len(word) && strings.EqualFold(choice[:len(word)], word) {
+			matches = append(matches, choice)
+		}
+	}
+	return start, matches
+}
+
+// readLine reads one line, editing it in place when the terminal is raw.
+func (sh *Shell) readLine(prompt string) (string, error) {
+	fmt.Fprint(sh.out, prompt)
+	if !sh.raw {
+		line, err := sh.in.ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	var line []rune
+	for {
+		r, _, err := sh.in.ReadRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			fmt.Fprint(sh.out, "\n")
+			return string(line), nil
+		case 0x03: // Ctrl-C drops the line
+			fmt.Fprint(sh.out, "^C\n"+prompt)
+			line = line[:0]
+		case 0x04: // Ctrl-D on an empty line ends the session
+			if len(line) == 0 {
+				fmt.Fprint(sh.out, "\n")
+				return "", io.EOF
+			}
+		case 0x7f, 0x08:
+			if len(line) > 0 {
+				line = line[:len(line)-1]
+				fmt.Fprint(sh.out, "\b \b")
+			}
+		case '\t':
+			line = sh.tab(prompt, line)
+		case 0x1b: // drop arrow keys and other escape sequences
+			if next, _ := sh.in.Peek(1); len(next) == 1 && next[0] == '[' {
+				sh.in.ReadByte()
+				for {
+					b, err := sh.in.ReadByte()
+					if err != nil || (b >= 0x40 && b <= 0x7e) {
+						break
+					}
+				}
+			}
+		default:
+			if unicode.IsPrint(r) {
+				line = append(line, r)
+				fmt.Fprint(sh.out, string(r))
+			}
+		}
+	}
+}
+
+// tab extends the last word to the longest prefix its completions share,
+// and lists them when that adds nothing.
+func (sh *Shell) tab(prompt string, line []rune) []rune {
+	text := string(line)
+	start, matches := sh.complete(text)
+	if len(matches) == 0 {
+		fmt.Fprint(sh.out, "\a")
+		return line
+	}
+	common := matches[0]
+	for _, m := range matches[1:] {
+		for !strings.HasPrefix(m, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	word := text[start:]
+	if len(common) > len(word) {
+		fmt.Fprint(sh.out, strings.Repeat("\b \b", utf8.RuneCountInString(word))+common)
+		text = text[:start] + common
+		if len(matches) == 1 && !strings.HasSuffix(common, ":") && !strings.HasSuffix(common, "=") {
+			fmt.Fprint(sh.out, " ")
+			text += " "
+		}
+		return []rune(text)
+	}
+	fmt.Fprint(sh.out, "\n"+strings.Join(matches, "  ")+"\n"+prompt+text)
+	return line
+}
+
+// rawTerminal puts the terminal f into raw mode, so the shell sees Tab
+// and every other key as it is typed. Raw mode also stops the terminal
+// from starting a new line at "\n", so it returns out wrapped to write
+// "\r\n" instead. It fails when f is not a terminal.
+func rawTerminal(f *os.File, out io.Writer) (io.Writer, func(), error) {
+	fd := int(f.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, nil, errors.New("input is not a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return nil, nil, err
+	}
+	return crlfWriter{out}, func() { term.Restore(fd, state) }, nil
+}
+
+// crlfWriter writes "\n" as "\r\n".
+type crlfWriter struct {
+	w io.Writer
+}
+
+func (cw crlfWriter) Write(p []byte) (int, error) {
+	if _, err := cw.w.Write(bytes.ReplaceAll(p, []byte("\n"), []byte("\r\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
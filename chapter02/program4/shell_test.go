@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestShellImport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"good.csv":  "kind,title,last,genre\nfiction,Dune,Herbert,scifi\nfiction,Dune,Herbert,space\n",
+		"bad.csv":   "kind,colour\nfiction,red\n",
+		"bad.mrc":   "00010nam a2200000 i 4500",
+		"books.bib": "@book{dune, title = {Dune}, author = {Herbert, Frank}, keywords = {scifi}}\n",
+	}
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, test := range []struct {
+		line, out string // out is "" for a command that must fail
+	}{
+		{"import good.csv", "1 added, 1 rejected"},
+		{"import bad.csv", ""},
+		{"import bad.mrc", ""},
+		{"import missing.csv", ""},
+		{"import books.bib kind=fiction", "1 added, 0 rejected"},
+	} {
+		var out bytes.Buffer
+		sh := NewShell(&Catalogue{}, strings.NewReader(""), &out)
+		line := strings.Replace(test.line, "import ", "import "+dir+string(filepath.Separator), 1)
+		err := sh.Exec(line)
+		switch {
+		case test.out == "" && err == nil:
+			t.Errorf("%s succeeded: %s", test.line, out.String())
+		case test.out == "" && strings.Contains(out.String(), "<nil>"):
+			t.Errorf("%s printed %q", test.line, out.String())
+		case test.out != "" && err != nil:
+			t.Errorf("%s: %v", test.line, err)
+		case test.out != "" && !strings.HasPrefix(out.String(), test.out):
+			t.Errorf("%s printed %q, want %q", test.line, out.String(), test.out)
+		}
+	}
+}
+
+func TestShellFind(t *testing.T) {
+	for _, test := range []struct {
+		line    string
+		suggest bool
+	}{
+		{"find last:king", false},
+		{"find last:king,shelly", false},
+		{"find last:kinq", true},
+		{"find last:shelly", true},
+		{"find last:qqqqqq", false},
+	} {
+		var out bytes.Buffer
+		sh := NewShell(sampleCatalogue(t), strings.NewReader(""), &out)
+		if err := sh.Exec(test.line); err != nil {
+			t.Fatalf("%s: %v", test.line, err)
+		}
+		if got := strings.Contains(out.String(), "did you mean"); got != test.suggest {
+			t.Errorf("%s suggested %v, want %v:\n%s", test.line, got, test.suggest, out.String())
+		}
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	textcollate "golang.org/x/text/collate"
+	"golang.org/x/text/language"
+	"golang.org/x/text/unicode/norm"
+)
+
+// SortKey orders results by one key. Strings are compared with the
+// collation function, ints numerically and enums by their position in the
+// vocabulary. A multi-valued key sorts by its first value. Books without
+// the key come last in either direction.
+type SortKey struct {
+	Key  Key
+	Desc bool
+}
+
+func (sk SortKey) String() string {
+	if sk.Desc {
+		return "-" + sk.Key.String()
+	}
+	return sk.Key.String()
+}
+
+// ParseSort reads a comma-separated list of keys, each descending if it
+// starts with '-': "last,-year".
+func ParseSort(text string) ([]SortKey, error) {
+	var keys []SortKey
+	for _, field := range strings.Split(text, ",") {
+		field = strings.TrimSpace(field)
+		desc := strings.HasPrefix(field, "-")
+		name := strings.TrimPrefix(field, "-")
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown sort key %q", name)
+		}
+		keys = append(keys, SortKey{Key: k, Desc: desc})
+	}
+	return keys, nil
+}
+
+// FindOptions orders and pages the results of FindPage.
+type FindOptions struct {
+	Sort    []SortKey // ties, and an empty Sort, fall back to ID order
+	Collate func(a, b string) int
+	Locale  string // a BCP 47 tag such as "sv" or "de-u-co-phonebk"; replaces Collate
+	Offset  int
+	Limit   int    // 0 returns every book from Offset on
+	Cursor  string // Page.Next of the previous page; replaces Offset
+}
+
+// Page is one page of sorted results. Next is the cursor for the
+// following page, or "" on the last one.
+type Page struct {
+	Books  []*Book
+	Total  int // books matching the query
+	Offset int // position of Books[0] in the full result
+	Next   string
+}
+
+// ErrBadCursor is returned for a cursor that FindPage did not issue for
+// the same sort order.
+var ErrBadCursor = errors.New("invalid cursor")
+
+// FindPage runs q and returns the requested page of the sorted results.
+// A cursor continues after the last book of the page it came from, so
+// books added or removed in between do not shift the pages that follow.
+func (c *Catalogue) FindPage(q Query, opts FindOptions) (*Page, error) {
+	if opts.Offset < 0 || opts.Limit < 0 {
+		return nil, fmt.Errorf("negative offset or limit")
+	}
+	collate := opts.Collate
+	if opts.Locale != "" {
+		var err error
+		if collate, err = LocaleCollate(opts.Locale); err != nil {
+			return nil, err
+		}
+	} else if collate == nil {
+		collate = Collate
+	}
+	matches := c.Find(q)
+	rows := make([]sortRow, len(matches))
+	for i, book := range matches {
+		rows[i] = newSortRow(book, opts.Sort)
+	}
+	sort.Slice(rows, func(i, j int) bool { return compareRows(rows[i], rows[j], opts.Sort, collate) < 0 })
+
+	start := opts.Offset
+	if opts.Cursor != "" {
+		after, err := decodeCursor(opts.Cursor, opts.Sort)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(rows), func(i int) bool { return compareRows(rows[i], after, opts.Sort, collate) > 0 })
+	}
+	start = min(start, len(rows))
+	end := len(rows)
+	if opts.Limit > 0 {
+		end = min(start+opts.Limit, len(rows))
+	}
+	page := &Page{Total: len(rows), Offset: start, Books: make([]*Book, 0, end-start)}
+	for _, row := range rows[start:end] {
+		page.Books = append(page.Books, row.book)
+	}
+	if end < len(rows) && end > start {
+		page.Next = encodeCursor(rows[end-1], opts.Sort)
+	}
+	return page, nil
+}
+
+// sortRow holds a book's sort values: a string, an int64 or nil if the
+// book lacks the key.
+type sortRow struct {
+	book *Book
+	id   int
+	keys []interface{}
+}
+
+func newSortRow(book *Book, keys []SortKey) sortRow {
+	row := sortRow{book: book, id: book.ID, keys: make([]interface{}, len(keys))}
+	for i, sk := range keys {
+		vals := book.Attrs.values(sk.Key)
+		if len(vals) == 0 {
+			continue
+		}
+		switch v := vals[0].(type) {
+		case string:
+			row.keys[i] = v
+		case ISBN:
+			row.keys[i] = string(v)
+		default:
+			row.keys[i] = ordinal(v)
+		}
+	}
+	return row
+}
+
+func compareRows(a, b sortRow, keys []SortKey, collate func(a, b string) int) int {
+	for i, sk := range keys {
+		x, y := a.keys[i], b.keys[i]
+		if x == nil || y == nil {
+			if x != nil {
+				return -1
+			}
+			if y != nil {
+				return 1
+			}
+			continue
+		}
+		var cmp int
+		if s, ok := x.(string); ok {
+			cmp = collate(s, y.(string))
+		} else {
+			cmp = compareInt(x.(int64), y.(int64))
+		}
+		if sk.Desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return compareInt(int64(a.id), int64(b.id))
+}
+
+func compareInt(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// cursorJSON is the content of a cursor before base64 encoding.
+type cursorJSON struct {
+	Sort string        `json:"sort"`
+	Keys []interface{} `json:"keys"`
+	ID   int           `json:"id"`
+}
+
+func sortSpec(keys []SortKey) string {
+	names := make([]string, len(keys))
+	for i, sk := range keys {
+		names[i] = sk.String()
+	}
+	return strings.Join(names, ",")
+}
+
+func encodeCursor(row sortRow, keys []SortKey) string {
+	data, _ := json.Marshal(cursorJSON{Sort: sortSpec(keys), Keys: row.keys, ID: row.id})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(cursor string, keys []SortKey) (sortRow, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return sortRow{}, ErrBadCursor
+	}
+	var cj cursorJSON
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&cj); err != nil || cj.Sort != sortSpec(keys) || len(cj.Keys) != len(keys) {
+		return sortRow{}, ErrBadCursor
+	}
+	row := sortRow{id: cj.ID, keys: cj.Keys}
+	for i, v := range row.keys {
+		spec, _ := DefaultSchema.Spec(keys[i].Key)
+		switch val := v.(type) {
+		case nil:
+		case string:
+			if spec.Type != TYPE_STRING && spec.Type != TYPE_ISBN {
+				return sortRow{}, ErrBadCursor
+			}
+		case json.Number:
+			n, err := val.Int64()
+			if err != nil || spec.Type == TYPE_STRING || spec.Type == TYPE_ISBN {
+				return sortRow{}, ErrBadCursor
+			}
+			row.keys[i] = n
+		default:
+			return sortRow{}, ErrBadCursor
+		}
+	}
+	return row, nil
+}
+
+// Collate orders strings for display the same way in every language:
+// accents and case are ignored at first and runs of digits compare by
+// value, so "Title 9" sorts before "title 10" and "Émile" beside "Emile".
+// Strings that tie are ordered unaccented first, then lower case first,
+// then by bytes. LocaleCollate follows the rules of one language instead.
+func Collate(a, b string) int {
+	var base Folding
+	if cmp, _ := collate(base.Fold(a), base.Fold(b)); cmp != 0 {
+		return cmp
+	}
+	cmp, caseOrder := collate(norm.NFC.String(a), norm.NFC.String(b))
+	switch {
+	case cmp != 0:
+		return cmp
+	case caseOrder != 0:
+		return caseOrder
+	}
+	return strings.Compare(a, b)
+}
+
+// LocaleCollate returns the Unicode collation of the language named by a
+// BCP 47 tag, such as "sv", where "Ö" sorts after "Z", or "de-u-co-phonebk"
+// for German phone book order. Runs of digits compare by value, as in
+// Collate. The function is not safe for concurrent use.
+func LocaleCollate(tag string) (func(a, b string) int, error) {
+	t, err := language.Parse(tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid locale %q", tag)
+	}
+	return textcollate.New(t, textcollate.Numeric).CompareString, nil
+}
+
+// collate compares a and b ignoring case, and reports separately how the
+// first difference in case orders them.
+func collate(a, b string) (cmp, caseOrder int) {
+	for a != "" && b != "" {
+		ra, na := utf8.DecodeRuneInString(a)
+		rb, nb := utf8.DecodeRuneInString(b)
+		if isDigit(ra) && isDigit(rb) {
+			da, db := digitRun(a), digitRun(b)
+			if cmp := compareDigits(da, db); cmp != 0 {
+				return cmp, 0
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+		if la != lb {
+			return compareInt(int64(la), int64(lb)), 0
+		}
+		if caseOrder == 0 && ra != rb {
+			// ToLower(r) == r means r is the lower case form
+			if ra == la {
+				caseOrder = -1
+			} else {
+				caseOrder = 1
+			}
+		}
+		a, b = a[na:], b[nb:]
+	}
+	return compareInt(int64(len(a)), int64(len(b))), caseOrder
+}
+
+func isDigit(r rune) bool { return '0' <= r && r <= '9' }
+
+func digitRun(s string) string {
+	i := 0
+	for i < len(s) && isDigit(rune(s[i])) {
+		i++
+	}
+	return s[:i]
+}
+
+// compareDigits compares two runs of decimal digits by value.
+func compareDigits(a, b string) int {
+	a, b = strings.TrimLeft(a, "0"), strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return compareInt(int64(len(a)), int64(len(b)))
+	}
+	return strings.Compare(a, b)
+}
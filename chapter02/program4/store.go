@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Store is an append-only log of catalogue records, one per line, after a
+// header naming the format and the highest ID ever handed out:
+//
+//	catalogue 1 last=1
+//	add 1 KIND=fiction TITLE="Life of Pi" LAST="Martel" FIRST="Yann" YEAR=2003 GENRE=adventure
+//	upd 1 KIND=fiction TITLE="Life of Pi" LAST="Martel" FIRST="Yann" YEAR=2001 GENRE=adventure
+//	del 1
+//
+// A multi-valued key is repeated once per value, in order:
+//
+//	add 2 KIND=fiction TITLE="Good Omens" LAST="Pratchett" LAST="Gaiman" GENRE=fantasy
+//
+// Records are never changed in place. Compact replaces the log with a
+// fresh copy holding only the live books. Append only writes a record;
+// it is on disk once Sync or Close returns.
+type Store struct {
+	path    string
+	file    *os.File
+	records int // records in the log
+	garbage int // records that no longer describe a live book
+	torn    bool
+	lastID  int
+}
+
+// Compaction runs once at least this many records are garbage and they
+// make up half of the log.
+const compactMinGarbage = 64
+
+const storeHeader = "catalogue 1"
+
+// record is one line of the log. attrs is nil for del.
+type record struct {
+	op    string
+	id    int
+	attrs *Attributes
+}
+
+// OpenStore reads the log at path, creating it if needed, and passes every
+// record to apply in order.
+// A partial record left by an interrupted write at the end of the log,
+// which lacks its newline, is dropped and cut off the file so the next
+// record starts on a line of its own.
+func OpenStore(path string, apply func(r record) error) (*Store, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	s := &Store{path: path}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = data[:bytes.LastIndexByte(data, '\n')+1]
+		if err := os.Truncate(path, int64(len(data))); err != nil {
+			return nil, err
+		}
+		s.torn = true
+	}
+	lines := strings.Split(string(data), "\n")
+	if len(data) > 0 {
+		if _, err := fmt.Sscanf(lines[0], storeHeader+" last=%d", &s.lastID); err != nil {
+			return nil, fmt.Errorf("%s:1: bad header %q", path, lines[0])
+		}
+		lines[0] = ""
+	}
+	for i, line := range lines {
+		if line == "" {
+			continue
+		}
+		r, err := decodeRecord(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, i+1, err)
+		}
+		if err := apply(r); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, i+1, err)
+		}
+		s.count(r)
+	}
+	if s.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		if _, err := fmt.Fprintf(s.file, "%s last=0\n", storeHeader); err != nil {
+			s.file.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) Append(r record) error {
+	if _, err := s.file.WriteString(encodeRecord(r)); err != nil {
+		return err
+	}
+	s.count(r)
+	return nil
+}
+
+func (s *Store) Sync() error { return s.file.Sync() }
+
+// count tracks how many records an update or delete has made garbage.
+func (s *Store) count(r record) {
+	s.records++
+	s.lastID = max(s.lastID, r.id)
+	switch r.op {
+	case "upd":
+		s.garbage++
+	case "del":
+		s.garbage += 2
+	}
+}
+
+func (s *Store) needsCompaction() bool {
+	return s.garbage >= compactMinGarbage && 2*s.garbage >= s.records
+}
+
+// Compact atomically replaces the log with one add record per live book.
+// lastID is kept in the header so IDs of removed books are not reused.
+func (s *Store) Compact(live []*Book, lastID int) error {
+	tmp := s.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "%s last=%d\n", storeHeader, lastID)
+	for _, book := range live {
+		sb.WriteString(encodeRecord(record{op: "add", id: book.ID, attrs: book.Attrs}))
+	}
+	if _, err = f.WriteString(sb.String()); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.file.Close()
+	if s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return err
+	}
+	s.records, s.garbage, s.torn, s.lastID = len(live), 0, false, lastID
+	return nil
+}
+
+func (s *Store) Close() error {
+	err := s.file.Sync()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func encodeRecord(r record) string {
+	var sb strings.Builder
+	sb.WriteString(r.op + " " + strconv.Itoa(r.id))
+	if r.attrs != nil {
+		for _, k := range r.attrs.sortedKeys() {
+			for _, v := range r.attrs.values(k) {
+				sb.WriteString(" " + k.String() + "=")
+				if str, ok := v.(string); ok {
+					sb.WriteString(strconv.Quote(str))
+				} else {
+					sb.WriteString(DefaultSchema.Format(k, v))
+				}
+			}
+		}
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// decodeRecord parses one line.
+func decodeRecord(line string) (record, error) {
+	var r record
+	var rest string
+	r.op, rest, _ = strings.Cut(line, " ")
+	switch r.op {
+	case "add", "upd", "del":
+	default:
+		return r, fmt.Errorf("unknown record %q", r.op)
+	}
+	var num string
+	num, rest, _ = strings.Cut(rest, " ")
+	n, err := strconv.Atoi(num)
+	if err != nil || n <= 0 {
+		return r, fmt.Errorf("bad book number %q", num)
+	}
+	r.id = n
+	if r.op == "del" {
+		return r, nil
+	}
+	pairs := map[Key]interface{}{}
+	for rest = strings.TrimLeft(rest, " "); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		name, after, ok := strings.Cut(rest, "=")
+		if !ok {
+			return r, fmt.Errorf("missing '=' in %q", rest)
+		}
+		k, ok := DefaultSchema.Lookup(name)
+		if !ok {
+			return r, fmt.Errorf("unknown key %q", name)
+		}
+		var text string
+		if strings.HasPrefix(after, `"`) {
+			quoted, err := strconv.QuotedPrefix(after)
+			if err != nil {
+				return r, fmt.Errorf("bad %s value: %v", k, err)
+			}
+			text, _ = strconv.Unquote(quoted)
+			rest = after[len(quoted):]
+		} else {
+			text, rest, _ = strings.Cut(after, " ")
+		}
+		v, err := DefaultSchema.Parse(k, text)
+		if err != nil {
+			return r, err
+		}
+		if prev, seen := pairs[k]; !seen {
+			pairs[k] = v
+		} else if DefaultSchema.multi(k) {
+			pairs[k] = append(listOf(prev), v)
+		} else {
+			return r, fmt.Errorf("%s given twice", k)
+		}
+	}
+	r.attrs, err = NewAttributes(pairs)
+	return r, err
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openTemp(t *testing.T, contents string) (string, *Catalogue, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "books.txt")
+	if contents != "" {
+		if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := OpenCatalogue(path, Folding{})
+	return path, c, err
+}
+
+func titles(c *Catalogue) string {
+	var titles []string
+	for _, book := range c.Books() {
+		titles = append(titles, book.Attrs.attrMap[KEY_TITLE].(string))
+	}
+	return strings.Join(titles, ",")
+}
+
+func TestStoreReplay(t *testing.T) {
+	path, c, err := openTemp(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, title := range []string{"A", "B", "C"} {
+		if _, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: title, KEY_LAST: "X", KEY_GENRE: SCIFI})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := c.Update(2, M{KEY_TITLE: "B2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Remove(3); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = OpenCatalogue(path, Folding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := titles(c); got != "A,B2" {
+		t.Errorf("reopened catalogue holds %s, want A,B2", got)
+	}
+	id, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: "D", KEY_LAST: "X", KEY_GENRE: SCIFI}))
+	if err != nil || id != 4 {
+		t.Errorf("Add after reopening = %d, %v; want 4", id, err)
+	}
+}
+
+func TestStoreCompact(t *testing.T) {
+	path, c, err := openTemp(t, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if _, err := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: string(rune('A' + i)), KEY_LAST: "X", KEY_GENRE: SCIFI})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id := 1; id <= 10; id += 2 {
+		if err := c.Remove(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 6 || lines[0] != "catalogue 1 last=10" {
+		t.Fatalf("compacted log:\n%s", data)
+	}
+	for _, line := range lines[1:] {
+		if !strings.HasPrefix(line, "add ") {
+			t.Errorf("compacted log holds %q", line)
+		}
+	}
+
+	c, err = OpenCatalogue(path, Folding{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if got := titles(c); got != "B,D,F,H,J" {
+		t.Errorf("compacted catalogue holds %s, want B,D,F,H,J", got)
+	}
+	if id, _ := c.Add(MustAttributes(M{KEY_KIND: FICTION, KEY_TITLE: "K", KEY_LAST: "X", KEY_GENRE: SCIFI})); id != 11 {
+		t.Errorf("Add after compaction = %d, want 11", id)
+	}
+}
+
+func TestStoreCorrupt(t *testing.T) {
+	const book = `KIND=fiction TITLE="A" LAST="X" GENRE=scifi`
+	for _, test := range []struct {
+		name, log string
+		want      error
+	}{
+		{"header", "catalogue 2 last=1\nadd 1 " + book + "\n", nil},
+		{"no header", "add 1 " + book + "\n", nil},
+		{"duplicate add", "catalogue 1 last=1\nadd 1 " + book + "\nadd 1 " + book + "\n", ErrCorruptLog},
+		{"update of missing book", "catalogue 1 last=1\nupd 1 " + book + "\n", ErrNoBook},
+		{"delete of missing book", "catalogue 1 last=1\nadd 1 " + book + "\ndel 2\n", ErrNoBook},
+		{"bad record", "catalogue 1 last=1\nadd x " + book + "\n", nil},
+		{"invalid book", "catalogue 1 last=1\nadd 1 KIND=fiction TITLE=\"A\"\n", nil},
+	} {
+		_, c, err := openTemp(t, test.log)
+		if err == nil {
+			c.Close()
+			t.Errorf("%s: opened without error", test.name)
+			continue
+		}
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.want)
+		}
+	}
+}
+
+func TestStoreTornRecord(t *testing.T) {
+	const book = `KIND=fiction TITLE="A" LAST="X" GENRE=scifi`
+	path, c, err := openTemp(t, "catalogue 1 last=1\nadd 1 "+book+"\nadd 2 KIND=fic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(c); got != "A" {
+		t.Errorf("catalogue holds %s, want A", got)
+	}
+	c.Close()
+	data, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(data), "\n") || strings.Contains(string(data), "KIND=fic\n") {
+		t.Errorf("torn record left in the log:\n%s", data)
+	}
+}